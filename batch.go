@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	flag "github.com/spf13/pflag"
+	"golang.org/x/sync/errgroup"
+)
+
+// batchResult is written as a line of NDJSON for each URL in the batch
+type batchResult struct {
+	errorOutput
+	Entries []any `json:"entries"`
+}
+
+// parseBatchLine parses a "URL [FLAGS]" line where the flags override
+// the keys in opts for this URL only
+func parseBatchLine(line string, opts Options) (string, *Options, error) {
+	flags := flag.NewFlagSet("batch", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVarP(&opts.DataKey, "data-key", "D", opts.DataKey, "")
+	flags.StringVarP(&opts.EntryKey, "entry-key", "", opts.EntryKey, "")
+	flags.StringVarP(&opts.NextKey, "next-key", "N", opts.NextKey, "")
+	flags.StringVarP(&opts.NextPageKey, "next-page-key", "", opts.NextPageKey, "")
+	flags.StringVarP(&opts.LastKey, "last-key", "L", opts.LastKey, "")
+	flags.StringVarP(&opts.CountKey, "count-key", "C", opts.CountKey, "")
+	flags.StringVarP(&opts.ParamPage, "param-page", "P", opts.ParamPage, "")
+	if err := flags.Parse(strings.Fields(line)); err != nil {
+		return "", nil, err
+	}
+	if flags.NArg() != 1 {
+		return "", nil, fmt.Errorf("expected one URL in batch line: %s", line)
+	}
+	urlStr := flags.Arg(0)
+	if err := validateURL(urlStr); err != nil {
+		return urlStr, nil, err
+	}
+	return urlStr, &opts, nil
+}
+
+// runBatch fetches the URLs read from r, up to jobs at a time,
+// and writes a result line to w for each one as it completes
+func runBatch(ctx context.Context, r io.Reader, w io.Writer, opts *Options, jobs int) error {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	total, failed := 0, 0
+	write := func(urlStr string, entries []any, err error) error {
+		result := batchResult{errorOutput: errorOutput{URL: urlStr}, Entries: entries}
+		if err != nil {
+			result.errorOutput = newErrorOutput(urlStr, err)
+			// Keep the entries only when they would be output for a single URL
+			var partial *PartialError
+			if !opts.Partial && !errors.As(err, &partial) {
+				result.Entries = nil
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		total++
+		if err != nil {
+			failed++
+		}
+		return enc.Encode(&result)
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(jobs, 1))
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urlStr, options, err := parseBatchLine(line, *opts)
+		if err != nil {
+			if urlStr == "" {
+				urlStr = line
+			}
+			if err := write(urlStr, nil, err); err != nil {
+				g.Wait()
+				return err
+			}
+			continue
+		}
+		g.Go(func() error {
+			entries, err := unpage(ctx, urlStr, options)
+			return write(urlStr, entries, err)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d URLs failed", failed, total)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBatchLine(t *testing.T) {
+	opts := Options{DataKey: "data", ParamPage: "page"}
+
+	tests := []struct {
+		line      string
+		url       string
+		dataKey   string
+		paramPage string
+		wantErr   bool
+	}{
+		{"http://example.com", "http://example.com", "data", "page", false},
+		{"http://example.com --data-key items", "http://example.com", "items", "page", false},
+		{"-D items -P p http://example.com", "http://example.com", "items", "p", false},
+		{"--data-key items", "", "", "", true},
+		{"http://example.com http://example.org", "", "", "", true},
+		{"http://example.com --unknown", "", "", "", true},
+		{"example.com", "", "", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			urlStr, options, err := parseBatchLine(test.line, opts)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("Expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if urlStr != test.url || options.DataKey != test.dataKey || options.ParamPage != test.paramPage {
+				t.Errorf("got %s %q %q; want %s %q %q", urlStr, options.DataKey, options.ParamPage, test.url, test.dataKey, test.paramPage)
+			}
+		})
+	}
+
+	if opts.DataKey != "data" {
+		t.Errorf("parseBatchLine modified the options")
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/items":
+			json.NewEncoder(w).Encode(map[string]any{"items": []any{1, 2}})
+		case "/data":
+			json.NewEncoder(w).Encode(map[string]any{"data": []any{3}})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	input := strings.Join([]string{
+		"# comment",
+		server.URL + "/data",
+		"",
+		server.URL + "/items --data-key items",
+		server.URL + "/missing",
+	}, "\n")
+
+	opts := &Options{DataKey: "data", Timeout: 5 * time.Second}
+	var buf bytes.Buffer
+	err := runBatch(ctx, strings.NewReader(input), &buf, opts, 1)
+	if err == nil || err.Error() != "1 of 3 URLs failed" {
+		t.Errorf("Expected 1 of 3 URLs to fail, got %v", err)
+	}
+
+	expected := []string{
+		`{"url":"` + server.URL + `/data","entries":[3]}`,
+		`{"url":"` + server.URL + `/items","entries":[1,2]}`,
+		`{"error":"HTTP request failed with status 404: Not Found: 404 page not found\n","url":"` + server.URL + `/missing","status":404,"entries":null}`,
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, got %d: %s", len(expected), len(lines), buf.String())
+	}
+	for i, line := range lines {
+		var got, want any
+		json.Unmarshal([]byte(line), &got)
+		json.Unmarshal([]byte(expected[i]), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("line %d: got %s; want %s", i+1, line, expected[i])
+		}
+	}
+}
+
+func TestRunBatch_Cookies(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie("session"); err != nil || cookie.Value != "abc" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode([]any{1})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cookies, err := parseCookies("session=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{Timeout: 5 * time.Second, Cookies: cookies}
+	opts.Client = newClient(opts)
+
+	var buf bytes.Buffer
+	input := server.URL + "/a\n" + server.URL + "/b\n"
+	if err := runBatch(ctx, strings.NewReader(input), &buf, opts, 2); err != nil {
+		t.Fatalf("Expected the cookie to be sent, got %v: %s", err, buf.String())
+	}
+}
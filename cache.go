@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// cacheEntry is a page body saved along with the validators to revalidate it
+type cacheEntry struct {
+	URL          string      `json:"url"`
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"last_modified,omitempty"`
+	Header       http.Header `json:"header"`
+	Body         []byte      `json:"body"`
+}
+
+// cachePath returns the file for the URL, which includes the query parameters
+// so entries for other parameters are never used
+func cachePath(dir, urlStr string) string {
+	sum := sha256.Sum256([]byte(urlStr))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func loadCache(dir, urlStr string) (*cacheEntry, error) {
+	data, err := os.ReadFile(cachePath(dir, urlStr))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.URL != urlStr {
+		// Ignore corrupt or colliding entries
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+func storeCache(dir string, entry *cacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	// Concurrent runs never see partial entries
+	return writeFileAtomic(cachePath(dir, entry.URL), data, 0o600)
+}
+
+// writeFileAtomic writes to a temporary file in the same directory first
+// and then renames it to file so that it's never left half written
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// setValidators adds the conditional headers for a cached entry
+func setValidators(req *http.Request, entry *cacheEntry) {
+	if entry.ETag != "" {
+		req.Header.Set("If-None-Match", entry.ETag)
+	}
+	if entry.LastModified != "" {
+		req.Header.Set("If-Modified-Since", entry.LastModified)
+	}
+}
+
+// useCache replaces the response with the cached entry on 304 Not Modified
+// or saves a successful response that can be revalidated later
+func useCache(dir, urlStr string, resp *http.Response, entry *cacheEntry) error {
+	switch {
+	case resp.StatusCode == http.StatusNotModified && entry != nil:
+		resp.Body.Close()
+		resp.StatusCode = http.StatusOK
+		resp.Status = "200 OK"
+		resp.Header = entry.Header
+		resp.Body = io.NopCloser(bytes.NewReader(entry.Body))
+	case resp.StatusCode == http.StatusOK:
+		etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		if etag == "" && lastModified == "" {
+			return nil
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return storeCache(dir, &cacheEntry{
+			URL:          urlStr,
+			ETag:         etag,
+			LastModified: lastModified,
+			Header:       resp.Header,
+			Body:         body,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUnpage_CacheDir(t *testing.T) {
+	var hits, notModified atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		etag := `"v1-` + r.URL.Query().Get("page") + `"`
+		if r.URL.Query().Get("page") == "1" {
+			w.Header().Set("Link", `</?page=2>; rel="last"`)
+		}
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		json.NewEncoder(w).Encode([]any{r.URL.Query().Get("page")})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		ParamPage: "page",
+		Timeout:   5 * time.Second,
+		CacheDir:  t.TempDir(),
+	}
+
+	for i := range 2 {
+		entries, err := unpage(ctx, server.URL, opts)
+		if err != nil {
+			t.Fatalf("Run %d: expected no error, got %v", i, err)
+		}
+		if !reflect.DeepEqual(entries, []any{"1", "2"}) {
+			t.Errorf("Run %d: unexpected entries %v", i, entries)
+		}
+	}
+
+	if hits.Load() != 4 {
+		t.Errorf("Expected 4 requests, got %d", hits.Load())
+	}
+	if notModified.Load() != 2 {
+		t.Errorf("Expected 2 cached pages to be reused, got %d", notModified.Load())
+	}
+}
+
+func TestLoadCache(t *testing.T) {
+	dir := t.TempDir()
+	entry := &cacheEntry{
+		URL:  "https://example.com/?page=1",
+		ETag: `"abc"`,
+		Body: []byte(`[1]`),
+	}
+	if err := storeCache(dir, entry); err != nil {
+		t.Fatalf("storeCache returned an error: %v", err)
+	}
+
+	got, err := loadCache(dir, entry.URL)
+	if err != nil {
+		t.Fatalf("loadCache returned an error: %v", err)
+	}
+	if !reflect.DeepEqual(got, entry) {
+		t.Errorf("loadCache = %+v; want %+v", got, entry)
+	}
+
+	// Other query parameters don't match
+	got, err = loadCache(dir, "https://example.com/?page=2")
+	if err != nil || got != nil {
+		t.Errorf("Expected no entry, got %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// acceptEncoding is sent unless the Accept-Encoding header is given,
+// in which case the transport doesn't decompress gzip transparently
+const acceptEncoding = "gzip, deflate, br"
+
+// readCloser closes the underlying body after reading from the decompressor
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
+
+// decompressBody replaces the body with a reader that decompresses it
+// according to the Content-Encoding header, unless there's no body as
+// the decompressors read the header right away
+func decompressBody(resp *http.Response) error {
+	if !hasBody(resp) {
+		return nil
+	}
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	var reader io.Reader
+	switch encoding {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		reader = zr
+	case "deflate":
+		// Deflate is supposed to be zlib but some servers send raw deflate
+		br := bufio.NewReader(resp.Body)
+		if header, err := br.Peek(2); err == nil && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return err
+			}
+			reader = zr
+		} else {
+			reader = flate.NewReader(br)
+		}
+	case "br":
+		reader = brotli.NewReader(resp.Body)
+	default:
+		return fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+	resp.Body = &readCloser{Reader: reader, close: resp.Body.Close}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// hasBody is whether the response may have a body, as those to HEAD
+// requests and with the 204 and 304 statuses never do
+func hasBody(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusNotModified:
+		return false
+	}
+	return resp.ContentLength != 0
+}
+
+// gzipBody compresses the body of a request
+func gzipBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
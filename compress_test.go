@@ -0,0 +1,185 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestGetPage_ContentEncoding(t *testing.T) {
+	writers := map[string]func(io.Writer) io.WriteCloser{
+		"gzip": func(w io.Writer) io.WriteCloser {
+			return gzip.NewWriter(w)
+		},
+		"deflate": func(w io.Writer) io.WriteCloser {
+			return zlib.NewWriter(w)
+		},
+		"raw-deflate": func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		},
+		"br": func(w io.Writer) io.WriteCloser {
+			return brotli.NewWriter(w)
+		},
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.URL.Query().Get("encoding")
+		if r.Header.Get("Accept-Encoding") != acceptEncoding {
+			t.Errorf("Unexpected Accept-Encoding: %q", r.Header.Get("Accept-Encoding"))
+		}
+		header := encoding
+		if encoding == "raw-deflate" {
+			header = "deflate"
+		}
+		w.Header().Set("Content-Encoding", header)
+		cw := writers[encoding](w)
+		json.NewEncoder(cw).Encode(map[string]any{"encoding": encoding})
+		cw.Close()
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	for encoding := range writers {
+		t.Run(encoding, func(t *testing.T) {
+			params := map[string]string{"encoding": encoding}
+			resp, err := getPage(context.Background(), client, server.URL, params, &Options{})
+			if err != nil {
+				t.Fatalf("getPage returned an error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			var result map[string]any
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if result["encoding"] != encoding {
+				t.Errorf("Unexpected response body: %v", result)
+			}
+			if resp.Header.Get("Content-Encoding") != "" {
+				t.Errorf("Expected Content-Encoding to be removed")
+			}
+		})
+	}
+}
+
+func TestGetPage_ContentEncodingNoBody(t *testing.T) {
+	// The header is repeated in the responses to HEAD and in the 304s
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("X-Total-Pages", "3")
+		if r.Method == http.MethodHead {
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		zw := gzip.NewWriter(w)
+		json.NewEncoder(zw).Encode([]any{1})
+		zw.Close()
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	opts := &Options{
+		ParamPage:        "page",
+		TotalPagesHeader: "X-Total-Pages",
+		CacheDir:         t.TempDir(),
+	}
+	if pages := probeLastPage(ctx, client, server.URL, opts); pages != 3 {
+		t.Errorf("Expected 3 pages from the HEAD request, got %d", pages)
+	}
+	for i := range 2 {
+		entries, err := getPageEntries(ctx, client, server.URL, nil, opts)
+		if err != nil {
+			t.Fatalf("Request %d returned an error: %v", i+1, err)
+		}
+		if expected := numbers(1); !reflect.DeepEqual(entries, expected) {
+			t.Errorf("Expected %v, got %v", expected, entries)
+		}
+	}
+}
+
+func TestGetPage_UnsupportedEncoding(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "zstd")
+		w.Write([]byte("garbage"))
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	if _, err := getPage(context.Background(), client, server.URL, nil, &Options{}); err == nil {
+		t.Errorf("Expected error for unsupported encoding")
+	}
+}
+
+func TestDoRequest_GzipRequest(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		data, _ := io.ReadAll(body)
+		json.NewEncoder(w).Encode(map[string]any{
+			"encoding": r.Header.Get("Content-Encoding"),
+			"body":     string(data),
+		})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	tests := []struct {
+		method   string
+		body     []byte
+		expected map[string]any
+	}{
+		{http.MethodPost, []byte(`{"query":{}}`), map[string]any{"encoding": "gzip", "body": `{"query":{}}`}},
+		{http.MethodGet, nil, map[string]any{"encoding": "", "body": ""}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			opts := &Options{GzipRequest: true}
+			client := &http.Client{Timeout: 5 * time.Second}
+			resp, err := doRequest(context.Background(), client, test.method, server.URL, nil, test.body, opts)
+			if err != nil {
+				t.Fatalf("doRequest returned an error: %v", err)
+			}
+			defer resp.Body.Close()
+			var got map[string]any
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("got %v; want %v", got, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// expandEmit wraps emit to replace the link at opts.ExpandKey in each entry
+// with all the entries it paginates to, stored at opts.ExpandInto, fetching
+// the links of a page concurrently
+func expandEmit(ctx context.Context, client *http.Client, urlStr string, emit func(page int, entries []any) error, opts *Options) func(page int, entries []any) error {
+	into := cmp.Or(opts.ExpandInto, opts.ExpandKey)
+
+	// Only one level deep with the same settings and client
+	options := *opts
+	options.ExpandKey, options.ExpandInto = "", ""
+	options.Client = client
+	options.Cookies = nil
+	options.Emit = nil
+	options.Transform = nil
+	options.AnnotatePage = ""
+	options.Until = nil
+	options.PagePlaceholder = ""
+
+	return func(page int, entries []any) error {
+		g, ctx := errgroup.WithContext(ctx)
+		g.SetLimit(concurrency)
+		for _, entry := range entries {
+			m, ok := entry.(map[string]any)
+			if !ok {
+				continue
+			}
+			link, ok := getNestedValue(m, opts.ExpandKey).(string)
+			if !ok || link == "" {
+				continue
+			}
+			g.Go(func() error {
+				children, err := expand(ctx, urlStr, link, &options)
+				if err != nil {
+					return err
+				}
+				setNestedValue(m, into, children)
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return &PageError{Page: page, Err: err}
+		}
+		return emit(page, entries)
+	}
+}
+
+// expand fetches all the entries from link, relative to urlStr
+func expand(ctx context.Context, urlStr, link string, opts *Options) ([]any, error) {
+	base, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	if link, err = resolveLink(base, link); err != nil {
+		return nil, err
+	}
+	children, err := unpage(ctx, link, opts)
+	// Keep what was fetched of the links with failed pages
+	var partial *PartialError
+	if errors.As(err, &partial) {
+		opts.logf(0, "WARNING: Expanding %s: %v", link, err)
+		return children, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expanding %s: %w", link, err)
+	}
+	return children, nil
+}
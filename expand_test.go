@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnpage_Expand(t *testing.T) {
+	// Two pages of parents, each with two pages of children
+	// that link to their own children which must not be expanded
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		w.Header().Set("Link", fmt.Sprintf(`<%s?page=2>; rel="last"`, r.URL.Path))
+		var data []any
+		if id, ok := strings.CutPrefix(r.URL.Path, "/children/"); ok {
+			if id == "3" {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			data = []any{map[string]any{"name": id + "." + strconv.Itoa(page), "children": "/children/3"}}
+		} else {
+			data = []any{map[string]any{"id": page, "children": fmt.Sprintf("children/%d", page)}, "other"}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": data})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	child := func(name string) any {
+		return map[string]any{"name": name, "children": "/children/3"}
+	}
+	tests := []struct {
+		name     string
+		into     string
+		expected func(id int, children []any) any
+	}{
+		{"replace", "", func(id int, children []any) any {
+			return map[string]any{"id": json.Number(strconv.Itoa(id)), "children": children}
+		}},
+		{"into", "items", func(id int, children []any) any {
+			return map[string]any{"id": json.Number(strconv.Itoa(id)), "children": fmt.Sprintf("children/%d", id), "items": children}
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := &Options{
+				ParamPage:  "page",
+				DataKey:    "data",
+				ExpandKey:  "children",
+				ExpandInto: test.into,
+				Timeout:    5 * time.Second,
+			}
+			entries, err := unpage(ctx, server.URL+"/parents", opts)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			expected := []any{
+				test.expected(1, []any{child("1.1"), child("1.2")}),
+				"other",
+				test.expected(2, []any{child("2.1"), child("2.2")}),
+				"other",
+			}
+			if !reflect.DeepEqual(entries, expected) {
+				t.Errorf("Expected %v, got %v", expected, entries)
+			}
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		opts := &Options{
+			ParamPage: "page",
+			DataKey:   "data",
+			ExpandKey: "children",
+			Timeout:   5 * time.Second,
+		}
+		_, err := unpage(ctx, server.URL+"/children/1", opts)
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+			t.Fatalf("Expected a 404 StatusError, got %v", err)
+		}
+	})
+}
@@ -3,6 +3,10 @@ module unpage
 go 1.22
 
 require (
+	github.com/andybalholm/brotli v1.2.6
+	github.com/itchyny/gojq v0.12.17
 	github.com/spf13/pflag v1.0.6
 	golang.org/x/sync v0.10.0
 )
+
+require github.com/itchyny/timefmt-go v0.1.6 // indirect
@@ -1,30 +1,54 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
 	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
 import flag "github.com/spf13/pflag"
 
 const version = "0.2.0"
 
-var debug bool
+// Maximum number of concurrent requests
+const concurrency = 50
+
+// Maximum number of redirects followed by default
+const defaultMaxRedirects = 10
+
+// Placeholder for the page number in --page-url-template
+const pagePlaceholder = "{page}"
 
 func getNestedValue(data map[string]any, key string) any {
+	// Keys with dots like @odata.nextLink
+	if value, ok := data[key]; ok {
+		return value
+	}
 	keys := strings.Split(key, ".")
 	var value any = data
 
@@ -41,6 +65,97 @@ func getNestedValue(data map[string]any, key string) any {
 	return value
 }
 
+// getInt gets the integer at key, accepting numbers encoded as strings
+func getInt(data map[string]any, key string) (int, error) {
+	switch value := getNestedValue(data, key).(type) {
+	case int:
+		return value, nil
+	case float64:
+		return int(value), nil
+	case json.Number:
+		if n, err := value.Int64(); err == nil {
+			return int(n), nil
+		}
+		// Accept whole numbers like 100.0 or 1e3
+		f, err := value.Float64()
+		if err != nil || f != math.Trunc(f) || math.Abs(f) > math.MaxInt32 {
+			return 0, fmt.Errorf("invalid number for %s: %q", key, value)
+		}
+		return int(f), nil
+	case string:
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 0)
+		if err != nil {
+			return 0, fmt.Errorf("non-numeric string for %s: %q", key, value)
+		}
+		return int(n), nil
+	default:
+		return 0, fmt.Errorf("unexpected type %T for %s", value, key)
+	}
+}
+
+// getLink gets the link at key, which may be a string or an object with the
+// link at hrefField like in HAL, returning an empty string if it's null
+func getLink(data map[string]any, key, hrefField string) (string, error) {
+	switch value := getNestedValue(data, key).(type) {
+	case string:
+		return value, nil
+	case nil:
+		return "", nil
+	case map[string]any:
+		if link, ok := value[hrefField].(string); ok {
+			return link, nil
+		}
+	}
+	return "", fmt.Errorf("unexpected type for %s", key)
+}
+
+// nextPageLink returns the URL for the page number at opts.NextPageKey
+// or an empty string if it's null or zero
+func nextPageLink(urlStr string, body map[string]any, opts *Options) (string, error) {
+	if getNestedValue(body, opts.NextPageKey) == nil {
+		return "", nil
+	}
+	page, err := getInt(body, opts.NextPageKey)
+	if err != nil || page == 0 {
+		return "", err
+	}
+	urlStr, params := opts.pageURL(urlStr, page)
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	for k, v := range params {
+		q.Set(k, v)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func setNestedValue(data map[string]any, key string, value any) {
+	keys := strings.Split(key, ".")
+	for _, k := range keys[:len(keys)-1] {
+		m, ok := data[k].(map[string]any)
+		if !ok {
+			m = make(map[string]any)
+			data[k] = m
+		}
+		data = m
+	}
+	data[keys[len(keys)-1]] = value
+}
+
+// pickFields returns a new object with only the (dot-path) fields present in entry
+func pickFields(entry map[string]any, fields []string) map[string]any {
+	picked := make(map[string]any, len(fields))
+	for _, field := range fields {
+		if value := getNestedValue(entry, field); value != nil {
+			setNestedValue(picked, field, value)
+		}
+	}
+	return picked
+}
+
 func getNextLastLinks(header string) (next, last string) {
 	for _, chunk := range strings.Split(header, ",") {
 		var url, rel string
@@ -67,30 +182,114 @@ func getNextLastLinks(header string) (next, last string) {
 	return next, last
 }
 
-func logResponse(resp *http.Response) {
+// sleep waits for d unless the context is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// validateURL checks that the URL is an absolute HTTP or HTTPS URL
+func validateURL(urlStr string) error {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		if u.Scheme == "" {
+			return fmt.Errorf("missing scheme in URL %q", urlStr)
+		}
+		return fmt.Errorf("unsupported scheme %q in URL %q", u.Scheme, urlStr)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing host in URL %q", urlStr)
+	}
+	return nil
+}
+
+// resolveLink resolves a link that may be relative against the base URL
+func resolveLink(base *url.URL, link string) (string, error) {
+	ref, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+func logResponse(logger *log.Logger, resp *http.Response) {
 	dump, err := httputil.DumpRequestOut(resp.Request, true)
 	if err != nil {
 		log.Print(err)
 	} else {
-		fmt.Fprintf(os.Stderr, "\n%s", string(dump))
+		logger.Printf("\n%s", string(dump))
 	}
 
 	dump, err = httputil.DumpResponse(resp, true)
 	if err != nil {
 		log.Print(err)
 	} else {
-		fmt.Fprintf(os.Stderr, "\n%s\n", string(dump))
+		logger.Printf("\n%s\n", string(dump))
 	}
 }
 
-func getPage(ctx context.Context, client *http.Client, urlStr string, headers map[string]string, params map[string]string) (*http.Response, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+func logHeaders(logger *log.Logger, prefix string, header http.Header) {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range header[key] {
+			logger.Printf("%s %s: %s", prefix, key, value)
+		}
+	}
+}
+
+func getPage(ctx context.Context, client *http.Client, urlStr string, params map[string]string, opts *Options) (*http.Response, error) {
+	return doRequest(ctx, client, http.MethodGet, urlStr, params, nil, opts)
+}
+
+// doRequest sends the request with the JSON body, if any
+func doRequest(ctx context.Context, client *http.Client, method string, urlStr string, params map[string]string, body []byte, opts *Options) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		if opts.GzipRequest {
+			var err error
+			if body, err = gzipBody(body); err != nil {
+				return nil, err
+			}
+		}
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, urlStr, reader)
 	if err != nil {
 		return nil, err
 	}
-	for k, v := range headers {
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+		if opts.GzipRequest {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+	}
+	for k, v := range opts.Headers {
 		req.Header.Set(k, v)
 	}
+	if opts.PreferPageSize > 0 {
+		prefer := fmt.Sprintf("odata.maxpagesize=%d", opts.PreferPageSize)
+		if other := req.Header.Get("Prefer"); other != "" {
+			prefer = other + ", " + prefer
+		}
+		req.Header.Set("Prefer", prefer)
+	}
 	if params != nil {
 		q := req.URL.Query()
 		for k, v := range params {
@@ -99,254 +298,2085 @@ func getPage(ctx context.Context, client *http.Client, urlStr string, headers ma
 		req.URL.RawQuery = q.Encode()
 	}
 
-	resp, err := client.Do(req)
+	var cached *cacheEntry
+	useCacheDir := opts.CacheDir != "" && method == http.MethodGet
+	if useCacheDir {
+		if cached, err = loadCache(opts.CacheDir, req.URL.String()); err != nil {
+			return nil, err
+		}
+		if cached != nil {
+			setValidators(req, cached)
+		}
+	}
+
+	// Wait for the host before taking a slot that other hosts could use
+	if opts.HostLimiter != nil {
+		release, err := opts.HostLimiter.Acquire(ctx, req.URL.Host)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+	if opts.RateThrottle != nil {
+		release, err := opts.RateThrottle.Acquire(ctx, req.URL.Host, opts)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+	if opts.Limiter != nil {
+		if err := opts.Limiter.Acquire(ctx, 1); err != nil {
+			return nil, err
+		}
+		defer opts.Limiter.Release(1)
+	}
+
+	resp, err := doWithRetries(ctx, client, req, opts)
 	if err != nil {
 		return nil, err
 	}
+	if err := decompressBody(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	if logger := opts.Logger; logger != nil {
+		if opts.Verbose >= 1 {
+			logger.Printf("%s %s: %s", req.Method, req.URL, resp.Status)
+		}
+		if opts.Verbose == 2 {
+			logHeaders(logger, ">", req.Header)
+			logHeaders(logger, "<", resp.Header)
+		} else if opts.Verbose >= 3 {
+			logResponse(logger, resp)
+		}
+	}
 
-	if debug {
-		logResponse(resp)
+	if useCacheDir {
+		if err := useCache(opts.CacheDir, req.URL.String(), resp, cached); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		resp.Body.Close()
-		return nil, fmt.Errorf("HTTP request failed with status %d: %s: %s", resp.StatusCode, http.StatusText(resp.StatusCode), string(body))
+		return nil, &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 	return resp, nil
 }
 
-func unpage(ctx context.Context, urlStr string, headers map[string]string, paramPage, dataKey, nextKey, lastKey string, timeout time.Duration) ([]any, error) {
-	// Fetch the first page
-	client := &http.Client{
-		Timeout: timeout * time.Second,
-	}
-	params := make(map[string]string)
-	if paramPage != "" {
-		params[paramPage] = "1"
+// Options controls how unpage fetches and extracts the pages
+type Options struct {
+	Headers   map[string]string
+	ParamPage string
+	// PagePlaceholder, if set, is replaced in the URL with the page
+	// instead of setting ParamPage, for APIs with the page in the path
+	PagePlaceholder string
+	// PageStride, if set, sends (page-1)*PageStride in ParamPage
+	// for APIs that take an offset instead of a page number
+	PageStride int
+	DataKey    string
+	// SingleObject makes a value at DataKey that isn't an array, or the
+	// body without DataKey, the only entry of the page
+	SingleObject bool
+	// EntryKey replaces each entry with the value at this key
+	EntryKey    string
+	NextKey     string
+	NextPageKey string
+	LastKey     string
+	CountKey    string
+	// ExpandKey, if set, is the field with a link in each entry replaced
+	// by all the entries it paginates to, stored at ExpandInto if set
+	ExpandKey  string
+	ExpandInto string
+	// AnnotatePage is the field set to the page number in each entry
+	AnnotatePage string
+	// ContentType is "json" to decode the responses as JSON whatever their
+	// Content-Type, while by default those clearly not JSON fail, or "ndjson"
+	// for responses with a JSON value in each line
+	ContentType string
+	// ErrorKey fails the pages with a non-null value at this key
+	ErrorKey string
+	// StopOnEmpty stops following the next links at the first empty page
+	StopOnEmpty bool
+	// LinkHrefField is the field with the link when the value at NextKey
+	// or LastKey is an object, "href" by default
+	LinkHrefField string
+	// PerPage is the number of entries in each page to compute the number
+	// of pages from the count instead of the number in the first page
+	PerPage int
+	// BufferPages, if set, limits the pages fetched concurrently ahead of
+	// the next one to emit, bounding the entries held in memory
+	BufferPages int
+	// PreferPageSize asks OData servers for this many entries in each
+	// page with the odata.maxpagesize preference in the Prefer header
+	PreferPageSize int
+	// RetryEmpty is the number of times an empty page from a next link is
+	// fetched again before taking it as empty, for eventually consistent
+	// stores where the entries may not be there yet
+	RetryEmpty int
+	// MinPageSize fetches the pages sequentially instead of concurrently
+	// when PerPage isn't set and the first page has less entries than this,
+	// as a short first page would make many requests for the count
+	MinPageSize int
+	// CountHeader and TotalPagesHeader are the response headers with
+	// the total number of entries and pages, respectively
+	CountHeader      string
+	TotalPagesHeader string
+	// CountFallback fetches the pages after the last one sequentially
+	// when there are less entries than counted
+	CountFallback bool
+	// ProbeHead makes a HEAD request to get TotalPagesHeader
+	// and fetch all pages concurrently
+	ProbeHead       bool
+	Timeout         time.Duration
+	Delay           time.Duration
+	CacheDir        string
+	ContinueOnError bool
+	// RetryFailedTimeout, if set with ContinueOnError, fetches the pages
+	// that failed concurrently again one at a time after the rest with
+	// this timeout, holding the pages after them until then, unless
+	// BufferPages is set
+	RetryFailedTimeout time.Duration
+	// Partial returns or emits the entries fetched before an error
+	Partial bool
+	Pick    []string
+	// Transform, if set, replaces each entry with the values it returns
+	Transform func(entry any) ([]any, error)
+	// Until, if set, stops the pagination at the first entry for which it
+	// returns true, keeping the entries before it, for sorted feeds
+	Until func(entry any) bool
+	// Retries is the number of times a request is retried on network errors
+	// and the statuses in RetryOn, or the default ones if not set,
+	// waiting with exponential backoff and jitter up to RetryMaxWait
+	Retries      int
+	RetryOn      []int
+	RetryMaxWait time.Duration
+	// MaxRedirects is the maximum number of redirects to follow, with 0
+	// meaning the default, unless NoRedirects is set to follow none
+	MaxRedirects int
+	NoRedirects  bool
+	// Scroll uses the Elasticsearch scroll API with the id at ScrollIDKey,
+	// posting it to ScrollURL to keep the context alive for ScrollTTL
+	// after posting the search in the URL query without a body
+	Scroll      bool
+	ScrollIDKey string
+	ScrollURL   string
+	ScrollTTL   string
+	// GzipRequest compresses the body of the requests that have one
+	GzipRequest bool
+	// UnixSocket is the path of the socket to connect to
+	UnixSocket string
+	// MaxConnsPerHost limits the connections to each host, 0 for no limit
+	MaxConnsPerHost int
+	// WrapTransport, if set, wraps the transport of the client created
+	// when Client is nil, e.g. for tracing with PageFromContext
+	WrapTransport func(http.RoundTripper) http.RoundTripper
+	// Sign, if set, is called to sign each request right before sending it,
+	// with the final URL and headers, e.g. with AWS Signature Version 4
+	Sign func(req *http.Request) error
+	// Client is used instead of a new one with Timeout if set
+	Client *http.Client
+	// Cookies are set in the jar of the client for the URL before fetching it
+	Cookies []*http.Cookie
+	// Limiter, if set, bounds the requests in flight across unpage calls
+	Limiter *semaphore.Weighted
+	// HostLimiter, if set, bounds the requests in flight to each host
+	HostLimiter *HostLimiter
+	// RateThrottle, if set, bounds the requests in flight to each host
+	// by the remaining requests in its rate-limit headers
+	RateThrottle *RateThrottle
+	// Verbose sets what is logged to Logger: 1 for each request & status,
+	// 2 for the headers too and 3 for the full dump of requests & responses
+	Verbose int
+	Logger  *log.Logger
+	// Emit, if set, is called with the entries of each page in page order
+	// as soon as they're available and unpage returns no entries
+	Emit func(page int, entries []any) error
+}
+
+// HostLimiter bounds the requests in flight to each host
+// so that a slow one doesn't take all the global slots
+type HostLimiter struct {
+	mu    sync.Mutex
+	n     int64
+	hosts map[string]*semaphore.Weighted
+}
+
+// NewHostLimiter returns a limiter of n requests per host
+func NewHostLimiter(n int) *HostLimiter {
+	return &HostLimiter{
+		n:     int64(n),
+		hosts: make(map[string]*semaphore.Weighted),
 	}
-	resp, err := getPage(ctx, client, urlStr, headers, params)
-	if err != nil {
-		return nil, err
+}
+
+// Acquire waits for a slot for host returning the function to release it
+func (l *HostLimiter) Acquire(ctx context.Context, host string) (func(), error) {
+	l.mu.Lock()
+	sem, ok := l.hosts[host]
+	if !ok {
+		sem = semaphore.NewWeighted(l.n)
+		l.hosts[host] = sem
 	}
-	var rawBody any
-	if err := json.NewDecoder(resp.Body).Decode(&rawBody); err != nil {
+	l.mu.Unlock()
+	if err := sem.Acquire(ctx, 1); err != nil {
 		return nil, err
 	}
-	resp.Body.Close()
+	return func() { sem.Release(1) }, nil
+}
 
-	var nextLink, lastLink string
-	var entries []any
-	var ok bool
+// StatusError is returned when the server responds with a status other than 200
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("HTTP request failed with status %d: %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// PageError records the failure to fetch a single page
+type PageError struct {
+	Page int
+	Err  error
+}
+
+func (e *PageError) Error() string {
+	return fmt.Sprintf("page %d: %v", e.Page, e.Err)
+}
+
+func (e *PageError) Unwrap() error {
+	return e.Err
+}
+
+// PartialError is returned along with the entries that could be fetched
+// when some pages failed and Options.ContinueOnError is set
+type PartialError struct {
+	Failed []*PageError
+	Total  int
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%d of %d pages failed", len(e.Failed), e.Total)
+}
+
+func getEntries(rawBody any, dataKey string, singleObject bool) ([]any, error) {
 	switch body := rawBody.(type) {
 	case map[string]any:
-		if entries, ok = getNestedValue(body, dataKey).([]any); !ok {
-			return nil, fmt.Errorf("unexpected type for dataKey")
-		}
-		// Pagination done via data
-		if nextKey != "" {
-			if nextLink, ok = getNestedValue(body, nextKey).(string); !ok {
-				return nil, fmt.Errorf("unexpected value for nextKey")
+		if dataKey == "" {
+			if singleObject {
+				return []any{body}, nil
 			}
+			return nil, fmt.Errorf("unexpected type for dataKey")
 		}
-		if lastKey != "" {
-			if lastLink, ok = getNestedValue(body, lastKey).(string); !ok {
-				return nil, fmt.Errorf("unexpected value for lastKey")
+		// A null or missing key is an empty page
+		switch entries := getNestedValue(body, dataKey).(type) {
+		case []any:
+			return entries, nil
+		case nil:
+			return []any{}, nil
+		default:
+			if singleObject {
+				return []any{entries}, nil
 			}
+			return nil, fmt.Errorf("unexpected type %T for dataKey", entries)
 		}
 	case []any:
-		entries = body
+		return body, nil
 	default:
 		return nil, fmt.Errorf("wrong type %T", body)
 	}
+}
 
-	// Pagination done via Link headers
-	if nextKey == "" {
-		nextLink, lastLink = getNextLastLinks(resp.Header.Get("Link"))
+// extractEntries gets the entries from the body and applies the per-entry options
+func extractEntries(rawBody any, opts *Options) ([]any, error) {
+	entries, err := getEntries(rawBody, opts.DataKey, opts.SingleObject)
+	if err != nil {
+		return nil, err
 	}
-
-	// If last Link is available, calculate the number of pages
-	if lastLink != "" {
-		if strings.HasPrefix(lastLink, "/") {
-			lastLink = fmt.Sprintf("%s://%s%s", resp.Request.URL.Scheme, resp.Request.URL.Host, lastLink)
+	if opts.EntryKey != "" {
+		for i, entry := range entries {
+			if m, ok := entry.(map[string]any); ok {
+				entries[i] = getNestedValue(m, opts.EntryKey)
+			}
 		}
-		lastURL, err := url.Parse(lastLink)
-		if err != nil {
-			return nil, err
+	}
+	if len(opts.Pick) > 0 {
+		for i, entry := range entries {
+			if m, ok := entry.(map[string]any); ok {
+				entries[i] = pickFields(m, opts.Pick)
+			}
 		}
-		lastPage, err := strconv.Atoi(lastURL.Query().Get(paramPage))
-		if err != nil {
-			return nil, err
+	}
+	return entries, nil
+}
+
+// transformEmit wraps emit to pass the transformed entries
+func transformEmit(emit func(page int, entries []any) error, transform func(entry any) ([]any, error)) func(page int, entries []any) error {
+	// Pages are emitted in order so this is the index in the output
+	index := 0
+	return func(page int, entries []any) error {
+		transformed := make([]any, 0, len(entries))
+		for _, entry := range entries {
+			values, err := transform(entry)
+			if err != nil {
+				return fmt.Errorf("transform entry %d: %w", index, err)
+			}
+			transformed = append(transformed, values...)
+			index++
 		}
+		return emit(page, transformed)
+	}
+}
 
-		pages := make([][]any, lastPage)
-		pages[0] = entries
+// annotateEmit wraps emit to set field to the page number in object entries
+// warning once about the other entries
+func annotateEmit(emit func(page int, entries []any) error, field string, opts *Options) func(page int, entries []any) error {
+	var warn sync.Once
+	return func(page int, entries []any) error {
+		for _, entry := range entries {
+			if m, ok := entry.(map[string]any); ok {
+				m[field] = page
+			} else {
+				warn.Do(func() {
+					opts.logf(0, "WARNING: Not annotating entries that aren't objects")
+				})
+			}
+		}
+		return emit(page, entries)
+	}
+}
 
-		g, ctx := errgroup.WithContext(ctx)
-		g.SetLimit(50)
+// decodeBody decodes the JSON in r keeping the numbers as json.Number
+// so that large IDs don't lose precision as float64
+func decodeBody(r io.Reader) (any, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var body any
+	err := dec.Decode(&body)
+	return body, err
+}
 
-		// Fetch remaining pages concurrently
-		for page := 2; page <= lastPage; page++ {
-			g.Go(func() error {
-				params := map[string]string{
-					paramPage: strconv.Itoa(page),
-				}
-				resp, err := getPage(ctx, client, urlStr, headers, params)
-				if err != nil {
-					return err
-				}
-				defer resp.Body.Close()
-				var rawBody any
-				if err := json.NewDecoder(resp.Body).Decode(&rawBody); err != nil {
-					return err
-				}
+// checkErrorKey fails the responses with a non-null value at key as some APIs
+// report errors with a 200 status, leaving the body to be read again
+func checkErrorKey(resp *http.Response, key string) error {
+	if err := decompressBody(resp); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
 
-				var entries []any
-				var ok bool
-				switch body := rawBody.(type) {
-				case map[string]any:
-					if entries, ok = getNestedValue(body, dataKey).([]any); !ok {
-						return fmt.Errorf("unexpected type for dataKey")
-					}
-				case []any:
-					entries = body
-				default:
-					return fmt.Errorf("wrong type %T", body)
-				}
+	// Leave the bodies that aren't JSON objects to fail later
+	body, _ := decodeBody(bytes.NewReader(data))
+	m, ok := body.(map[string]any)
+	if !ok {
+		return nil
+	}
+	switch value := getNestedValue(m, key).(type) {
+	case nil:
+		return nil
+	case string:
+		return fmt.Errorf("error in response: %s", value)
+	default:
+		message, _ := json.Marshal(value)
+		return fmt.Errorf("error in response: %s", message)
+	}
+}
 
-				pages[page-1] = entries
-				return nil
-			})
+// decodeResponse decodes the JSON body of resp unless the server said
+// it's something else and opts.ContentType doesn't force it
+func decodeResponse(resp *http.Response, opts *Options) (any, error) {
+	switch opts.ContentType {
+	case "", "auto":
+		contentType := resp.Header.Get("Content-Type")
+		if !maybeJSON(contentType) {
+			data, _ := io.ReadAll(io.LimitReader(resp.Body, 100))
+			return nil, fmt.Errorf("unexpected Content-Type %q for JSON (use --content-type json to decode it anyway): %s", contentType, data)
 		}
+	case "json":
+	case "ndjson":
+		return decodeLines(resp.Body)
+	default:
+		return nil, fmt.Errorf("unsupported content type %q", opts.ContentType)
+	}
+	return decodeBody(resp.Body)
+}
 
-		// Wait for all goroutines to complete
-		if err := g.Wait(); err != nil {
+// decodeLines decodes the JSON values in each line of r into an array
+// to be handled like a page with a bare array
+func decodeLines(r io.Reader) (any, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	entries := make([]any, 0)
+	for {
+		var entry any
+		if err := dec.Decode(&entry); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
 			return nil, err
 		}
+		entries = append(entries, entry)
+	}
+}
 
-		// Flatten the pages into a single slice
-		var allEntries []any
-		for i := range pages {
-			allEntries = append(allEntries, pages[i]...)
-		}
-		return allEntries, nil
+// maybeJSON tells if the media type may have JSON, including text/plain
+// as sent by servers that sniff it and those that don't know better
+func maybeJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType == ""
+	}
+	return mediaType == "text/plain" || strings.HasSuffix(mediaType, "/json") || strings.HasSuffix(mediaType, "+json")
+}
 
+func getPageEntries(ctx context.Context, client *http.Client, urlStr string, params map[string]string, opts *Options) ([]any, error) {
+	resp, err := getPage(ctx, client, urlStr, params, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	rawBody, err := decodeResponse(resp, opts)
+	if err != nil {
+		return nil, err
 	}
+	return extractEntries(rawBody, opts)
+}
 
-	// Iterate using next Link
-	for nextLink != "" {
-		if strings.HasPrefix(nextLink, "/") {
-			nextLink = fmt.Sprintf("%s://%s%s", resp.Request.URL.Scheme, resp.Request.URL.Host, nextLink)
-		}
-		resp, err := getPage(ctx, client, nextLink, headers, nil)
-		if err != nil {
-			return nil, err
-		}
-		defer resp.Body.Close()
+// orderedEmitter passes pages arriving in any order to emit in page order,
+// holding only those that arrived before their predecessors
+type orderedEmitter struct {
+	mu      sync.Mutex
+	next    int
+	pending map[int][]any
+	emit    func(page int, entries []any) error
+}
 
-		if err := json.NewDecoder(resp.Body).Decode(&rawBody); err != nil {
-			return nil, err
+// newOrderedEmitter returns an emitter for the pages starting with next
+func newOrderedEmitter(emit func(page int, entries []any) error, next int) *orderedEmitter {
+	return &orderedEmitter{
+		next:    next,
+		pending: make(map[int][]any),
+		emit:    emit,
+	}
+}
+
+// flush emits the pages still pending in order, skipping the missing ones
+func (o *orderedEmitter) flush() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	pages := make([]int, 0, len(o.pending))
+	for page := range o.pending {
+		pages = append(pages, page)
+	}
+	sort.Ints(pages)
+	for _, page := range pages {
+		entries := o.pending[page]
+		delete(o.pending, page)
+		if err := o.emit(page, entries); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		var more []any
-		switch body := rawBody.(type) {
-		case map[string]any:
-			if more, ok = getNestedValue(body, dataKey).([]any); !ok {
-				return nil, fmt.Errorf("unexpected type for dataKey")
-			}
-			if nextKey != "" {
-				switch link := getNestedValue(body, nextKey).(type) {
-				case string:
-					nextLink = link
-				case nil:
-					nextLink = ""
-				default:
-					return nil, fmt.Errorf("unexpected type for nextKey")
-				}
-			}
-		case []any:
-			more = body
-		default:
-			return nil, fmt.Errorf("wrong type %T", body)
+func (o *orderedEmitter) add(page int, entries []any) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.pending[page] = entries
+	for {
+		entries, ok := o.pending[o.next]
+		if !ok {
+			return nil
 		}
+		delete(o.pending, o.next)
+		if err := o.emit(o.next, entries); err != nil {
+			return err
+		}
+		o.next++
+	}
+}
+
+// newClient returns a client with a cookie jar to keep session cookies across pages
+func newClient(opts *Options) *http.Client {
+	jar, _ := cookiejar.New(nil)
+	var transport http.RoundTripper = newTransport(opts)
+	if opts.WrapTransport != nil {
+		transport = opts.WrapTransport(transport)
+	}
+	return &http.Client{
+		Transport:     transport,
+		Timeout:       opts.Timeout,
+		Jar:           jar,
+		CheckRedirect: checkRedirect(opts),
+	}
+}
 
-		if nextKey == "" {
-			nextLink, _ = getNextLastLinks(resp.Header.Get("Link"))
+// newTransport keeps enough idle connections to reuse them across
+// the concurrent requests instead of the default of 2 per host
+func newTransport(opts *Options) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxConnsPerHost = opts.MaxConnsPerHost
+	transport.MaxIdleConnsPerHost = concurrency
+	if opts.MaxConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = min(opts.MaxConnsPerHost, concurrency)
+	}
+	transport.MaxIdleConns = max(transport.MaxIdleConns, 2*concurrency)
+	if opts.UnixSocket != "" {
+		// The URL only gives the path and the Host header
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", opts.UnixSocket)
 		}
+	}
+	return transport
+}
 
-		entries = append(entries, more...)
+// checkRedirect returns the redirect policy for the options
+func checkRedirect(opts *Options) func(req *http.Request, via []*http.Request) error {
+	maxRedirects := cmp.Or(opts.MaxRedirects, defaultMaxRedirects)
+	if opts.NoRedirects {
+		maxRedirects = 0
+	}
+	// The client already keeps the Authorization header
+	// on redirects to the same host or its subdomains
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > maxRedirects {
+			return fmt.Errorf("stopped after %d redirects at %s", max(maxRedirects, 0), req.URL)
+		}
+		return nil
 	}
-	return entries, nil
 }
 
-func init() {
-	log.SetFlags(0)
-	log.SetPrefix("ERROR: ")
+// setCookies sets the cookies in the jar of the client for urlStr
+func setCookies(client *http.Client, urlStr string, cookies []*http.Cookie) {
+	if client.Jar == nil || cookies == nil {
+		return
+	}
+	if u, err := url.Parse(urlStr); err == nil {
+		client.Jar.SetCookies(u, cookies)
+	}
 }
 
-func main() {
-	var opts struct {
-		headers   []string
-		dataKey   string
-		lastKey   string
-		nextKey   string
-		paramPage string
-		timeout   int
-		version   bool
+// parseCookies parses "name=value" pairs separated by semicolons
+func parseCookies(s string) ([]*http.Cookie, error) {
+	var cookies []*http.Cookie
+	for _, pair := range strings.Split(s, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if name = strings.TrimSpace(name); !ok || name == "" {
+			return nil, fmt.Errorf("invalid cookie: %s", pair)
+		}
+		cookies = append(cookies, &http.Cookie{Name: name, Value: strings.TrimSpace(value)})
 	}
+	return cookies, nil
+}
 
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] URL\n", os.Args[0])
-		flag.PrintDefaults()
+// logf logs to Logger if the verbosity is at least level
+func (opts *Options) logf(level int, format string, args ...any) {
+	if opts.Logger != nil && opts.Verbose >= level {
+		opts.Logger.Printf(format, args...)
 	}
-	flag.StringSliceVarP(&opts.headers, "header", "H", nil, "HTTP header (may be specified multiple times")
-	flag.StringVarP(&opts.dataKey, "data-key", "D", "", "key to access the data in the JSON response")
-	flag.StringVarP(&opts.nextKey, "next-key", "N", "", "key to access the next page link in the JSON response")
-	flag.StringVarP(&opts.lastKey, "last-key", "L", "", "key to access the last page link in the JSON response")
-	flag.StringVarP(&opts.paramPage, "param-page", "P", "", "parameter that represents the page number")
-	flag.IntVarP(&opts.timeout, "timeout", "t", 60, "timeout")
-	flag.BoolVarP(&opts.version, "version", "", false, "print version and exit")
-	flag.Parse()
+}
 
-	if opts.version {
-		fmt.Printf("unpage v%s %v %s/%s\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
-		os.Exit(0)
+// pageSize is the number of entries in each page, as in the first one unless
+// given by opts.PerPage as it may be short when there are few entries
+func (opts *Options) pageSize(first []any) int {
+	if opts.PerPage > 0 {
+		return opts.PerPage
 	}
-	if flag.NArg() != 1 {
-		flag.Usage()
-		os.Exit(1)
+	return len(first)
+}
+
+// pageValue is the value of ParamPage for the page, which is the offset
+// of its first entry if PageStride is set
+func (opts *Options) pageValue(page int) string {
+	if opts.PageStride > 0 {
+		return strconv.Itoa((page - 1) * opts.PageStride)
 	}
-	urlStr := flag.Args()[0]
+	return strconv.Itoa(page)
+}
 
-	debug = os.Getenv("DEBUG") != ""
+// paged is whether the pages can be fetched by number
+func (opts *Options) paged() bool {
+	return opts.ParamPage != "" || opts.PagePlaceholder != ""
+}
 
-	headers := map[string]string{
-		"Accept":     "application/json",
-		"User-Agent": "unpage/" + version,
+// pageURL returns the URL and query parameters to fetch the page, with its
+// value in place of PagePlaceholder if set or in ParamPage otherwise
+func (opts *Options) pageURL(urlStr string, page int) (string, map[string]string) {
+	if opts.PagePlaceholder != "" {
+		return strings.ReplaceAll(urlStr, opts.PagePlaceholder, opts.pageValue(page)), nil
 	}
-	for _, header := range opts.headers {
-		parts := strings.SplitN(header, ":", 2)
-		if len(parts) != 2 {
-			log.Printf("Invalid header: %s", header)
-			os.Exit(1)
-		}
-		headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	return urlStr, map[string]string{
+		opts.ParamPage: opts.pageValue(page),
 	}
+}
 
-	timeout := time.Duration(opts.timeout) * time.Second
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+// pageNumber gets the value of the page in link, matching it against
+// the URL around PagePlaceholder if set or from ParamPage otherwise
+func (opts *Options) pageNumber(urlStr string, link *url.URL) (int, error) {
+	if opts.PagePlaceholder == "" {
+		return strconv.Atoi(link.Query().Get(opts.ParamPage))
+	}
+	prefix, suffix, _ := strings.Cut(urlStr, opts.PagePlaceholder)
+	value, ok := strings.CutPrefix(link.String(), prefix)
+	if value, ok2 := strings.CutSuffix(value, suffix); ok && ok2 {
+		return strconv.Atoi(value)
+	}
+	return 0, fmt.Errorf("%s doesn't match %s", link, urlStr)
+}
 
-	results, err := unpage(ctx, urlStr, headers, opts.paramPage, opts.dataKey, opts.nextKey, opts.lastKey, timeout)
-	if err != nil {
-		log.Print(err)
-		os.Exit(1)
+// checkPaging checks that the options to fetch the pages fit urlStr
+func checkPaging(urlStr string, opts *Options) error {
+	if opts.PagePlaceholder != "" {
+		if opts.ParamPage != "" {
+			return fmt.Errorf("pagePlaceholder and paramPage are mutually exclusive")
+		}
+		if !strings.Contains(urlStr, opts.PagePlaceholder) {
+			return fmt.Errorf("no %s in URL %q", opts.PagePlaceholder, urlStr)
+		}
+	}
+	if opts.NextPageKey != "" && !opts.paged() {
+		return fmt.Errorf("nextPageKey requires paramPage")
 	}
+	return nil
+}
 
-	output, err := json.Marshal(results)
-	if err != nil {
+// headerInt gets the integer in the header with name, if any
+func headerInt(header http.Header, name string) (int, bool) {
+	if name == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(header.Get(name)))
+	return n, err == nil
+}
+
+// countPages returns the number of pages needed for count entries
+func countPages(count, pageSize int) int {
+	if pageSize <= 0 {
+		return 1
+	}
+	return max((count+pageSize-1)/pageSize, 1)
+}
+
+// probeLastPage gets the number of pages from the headers of a HEAD request,
+// or from the count with PerPage, returning 0 if it's not available
+func probeLastPage(ctx context.Context, client *http.Client, urlStr string, opts *Options) int {
+	pageURL, params := opts.pageURL(urlStr, 1)
+	resp, err := doRequest(ctx, client, http.MethodHead, pageURL, params, nil, opts)
+	if err != nil {
+		opts.logf(1, "HEAD probe failed: %v", err)
+		return 0
+	}
+	resp.Body.Close()
+	if lastPage, ok := headerInt(resp.Header, opts.TotalPagesHeader); ok {
+		return lastPage
+	}
+	// Without a page the size of the first one can't be known
+	if count, ok := headerInt(resp.Header, opts.CountHeader); ok && opts.PerPage > 0 {
+		return countPages(count, opts.PerPage)
+	}
+	return 0
+}
+
+// fetchPages fetches the pages from start up to lastPage concurrently
+// after the previous ones were emitted
+func fetchPages(ctx context.Context, client *http.Client, urlStr string, opts *Options, emit func(page int, entries []any) error, start, lastPage int) error {
+	errs := make([]error, lastPage)
+
+	// Fetch no further than BufferPages ahead of the pages emitted
+	var window *semaphore.Weighted
+	if opts.BufferPages > 0 {
+		window = semaphore.NewWeighted(int64(opts.BufferPages))
+		emitPage := emit
+		emit = func(page int, entries []any) error {
+			defer window.Release(1)
+			return emitPage(page, entries)
+		}
+	}
+
+	// Hold the pages after a failed one to fetch it again at the end,
+	// which can't be done when holding them would stop the window
+	retryFailed := opts.ContinueOnError && opts.RetryFailedTimeout > 0 && window == nil
+
+	emitter := newOrderedEmitter(emit, start)
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+
+	// Fetch remaining pages concurrently
+	var err error
+	for page := start; page <= lastPage; page++ {
+		// Pause between batches
+		if page > start && (page-start)%concurrency == 0 {
+			if err := sleep(gctx, opts.Delay); err != nil {
+				g.Wait()
+				return err
+			}
+		}
+		if window != nil {
+			if err = window.Acquire(gctx, 1); err != nil {
+				break
+			}
+		}
+		g.Go(func() error {
+			pageURL, params := opts.pageURL(urlStr, page)
+			entries, err := getPageEntries(withPage(gctx, page), client, pageURL, params, opts)
+			if err != nil {
+				if !opts.ContinueOnError {
+					return &PageError{Page: page, Err: err}
+				}
+				errs[page-1] = err
+				if retryFailed {
+					return nil
+				}
+			}
+			return emitter.add(page, entries)
+		})
+	}
+
+	// Wait for all goroutines to complete, reporting the error that
+	// cancelled the context rather than the cancellation
+	if gerr := g.Wait(); gerr != nil || err != nil {
+		if opts.Partial {
+			emitter.flush()
+		}
+		return cmp.Or(gerr, err)
+	}
+
+	if retryFailed {
+		if err := retryFailedPages(ctx, client, urlStr, opts, emitter, errs); err != nil {
+			if opts.Partial {
+				emitter.flush()
+			}
+			return err
+		}
+	}
+
+	// Report the pages that failed along with what we got
+	var failed []*PageError
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, &PageError{Page: i + 1, Err: err})
+		}
+	}
+	if failed != nil {
+		return &PartialError{Failed: failed, Total: lastPage}
+	}
+	return nil
+}
+
+// retryFailedPages fetches the pages that failed again one at a time with
+// the longer RetryFailedTimeout, passing them to emitter as they come
+// whether they failed again or not
+func retryFailedPages(ctx context.Context, client *http.Client, urlStr string, opts *Options, emitter *orderedEmitter, errs []error) error {
+	lenient := *client
+	lenient.Timeout = opts.RetryFailedTimeout
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		page := i + 1
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := sleep(ctx, opts.Delay); err != nil {
+			return err
+		}
+		opts.logf(1, "Fetching failed page %d again", page)
+		pageURL, params := opts.pageURL(urlStr, page)
+		entries, err := getPageEntries(withPage(ctx, page), &lenient, pageURL, params, opts)
+		errs[i] = err
+		if err := emitter.add(page, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchSequential fetches the pages one at a time starting with start
+// until there are no remaining entries or a page is empty
+func fetchSequential(ctx context.Context, client *http.Client, urlStr string, opts *Options, emit func(page int, entries []any) error, start, remaining int) error {
+	for page := start; remaining > 0; page++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := sleep(ctx, opts.Delay); err != nil {
+			return err
+		}
+		pageURL, params := opts.pageURL(urlStr, page)
+		entries, err := getPageEntries(withPage(ctx, page), client, pageURL, params, opts)
+		if err != nil {
+			return &PageError{Page: page, Err: err}
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		if err := emit(page, entries); err != nil {
+			return err
+		}
+		remaining -= len(entries)
+	}
+	return nil
+}
+
+// Plan is how the rest of the pages are fetched as told by the first one
+type Plan struct {
+	URL  string `json:"url"`
+	Mode string `json:"mode"`
+	// Pages is the total number of pages, if known
+	Pages int `json:"pages,omitempty"`
+	// Count is the total number of entries, if known
+	Count   int    `json:"count,omitempty"`
+	Next    string `json:"next,omitempty"`
+	Last    string `json:"last,omitempty"`
+	Entries int    `json:"entries"`
+
+	// entries of the first page and its URL to resolve relative links
+	entries []any
+	base    *url.URL
+}
+
+// firstPage fetches the first page and works out how to fetch the rest
+func firstPage(ctx context.Context, client *http.Client, urlStr string, opts *Options) (*Plan, error) {
+	pageURL, params := urlStr, make(map[string]string)
+	if opts.paged() {
+		pageURL, params = opts.pageURL(urlStr, 1)
+	}
+	resp, err := getPage(withPage(ctx, 1), client, pageURL, params, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if opts.PreferPageSize > 0 {
+		applied := resp.Header.Get("Preference-Applied")
+		if strings.Contains(applied, "odata.maxpagesize") {
+			opts.logf(1, "Preference-Applied: %s", applied)
+		} else {
+			opts.logf(0, "WARNING: The server didn't apply odata.maxpagesize=%d", opts.PreferPageSize)
+		}
+	}
+	rawBody, err := decodeResponse(resp, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var nextLink, lastLink string
+	hrefField := cmp.Or(opts.LinkHrefField, "href")
+	entries, err := extractEntries(rawBody, opts)
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{
+		URL:     urlStr,
+		Entries: len(entries),
+		entries: entries,
+		base:    resp.Request.URL,
+	}
+	body, isMap := rawBody.(map[string]any)
+	if isMap {
+		// Pagination done via data
+		if opts.NextKey != "" {
+			if nextLink, err = getLink(body, opts.NextKey, hrefField); err != nil {
+				return nil, err
+			}
+		}
+		if opts.LastKey != "" {
+			if lastLink, err = getLink(body, opts.LastKey, hrefField); err != nil {
+				return nil, err
+			}
+		}
+		if opts.NextPageKey != "" {
+			if nextLink, err = nextPageLink(urlStr, body, opts); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Pagination done via Link headers
+	if !isMap || (opts.NextKey == "" && opts.NextPageKey == "") {
+		nextLink, lastLink = getNextLastLinks(resp.Header.Get("Link"))
+	}
+
+	// If last Link is available, calculate the number of pages
+	// or fall back to following the next Link if we can't
+	if lastLink != "" && opts.paged() {
+		// Relative to the first page even after redirects
+		if lastLink, plan.Pages, err = lastLinkPage(urlStr, resp.Request.URL, lastLink, opts); err != nil {
+			return nil, err
+		}
+		plan.Mode = "last link"
+	} else if isMap && opts.CountKey != "" && opts.paged() {
+		// Otherwise use the total count with the size of the first page
+		if plan.Count, err = getInt(body, opts.CountKey); err != nil {
+			return nil, err
+		}
+		plan.Pages = countPages(plan.Count, opts.pageSize(entries))
+		plan.Mode = "count key"
+	} else if opts.paged() {
+		// Or the headers
+		if n, ok := headerInt(resp.Header, opts.TotalPagesHeader); ok {
+			plan.Pages = n
+			plan.Mode = "total pages header"
+		} else if n, ok := headerInt(resp.Header, opts.CountHeader); ok {
+			plan.Count = n
+			plan.Pages = countPages(plan.Count, opts.pageSize(entries))
+			plan.Mode = "count header"
+		}
+	}
+	// Show the links as they'll be fetched, relative to the first page
+	for _, link := range []*string{&nextLink, &lastLink} {
+		if *link != "" {
+			if *link, err = resolveLink(resp.Request.URL, *link); err != nil {
+				return nil, err
+			}
+		}
+	}
+	plan.Next, plan.Last = nextLink, lastLink
+
+	counted := plan.Mode == "count key" || plan.Mode == "count header"
+	// Get the count even if not needed for the pages to check the entries
+	if !counted {
+		if isMap && opts.CountKey != "" {
+			plan.Count, _ = getInt(body, opts.CountKey)
+		} else if n, ok := headerInt(resp.Header, opts.CountHeader); ok {
+			plan.Count = n
+		}
+	}
+	if counted && opts.PerPage <= 0 && plan.Pages > 1 && len(entries) < opts.MinPageSize {
+		opts.logf(0, "WARNING: The first page has %d entries, less than %d, fetching the pages sequentially", len(entries), opts.MinPageSize)
+		plan.Pages = 0
+	}
+
+	if plan.Pages <= 0 {
+		switch {
+		case nextLink == "" && counted:
+			plan.Mode = "sequential pages"
+		case nextLink == "":
+			plan.Mode = "single page"
+		case isMap && opts.NextPageKey != "":
+			plan.Mode = "next page key"
+		case isMap && opts.NextKey != "":
+			plan.Mode = "next key"
+		default:
+			plan.Mode = "next link"
+		}
+	}
+	return plan, nil
+}
+
+// unpage fetches all the pages from the URL and returns their entries
+// in page order, even when the pages are fetched concurrently
+func unpage(ctx context.Context, urlStr string, opts *Options) (result []any, err error) {
+	// Collect the entries unless the caller wants them as they come
+	var allEntries []any
+	emit := opts.Emit
+	if emit == nil {
+		allEntries = make([]any, 0)
+		emit = func(_ int, entries []any) error {
+			allEntries = append(allEntries, entries...)
+			return nil
+		}
+	}
+	if opts.Partial {
+		defer func() {
+			if err != nil {
+				result = allEntries
+			}
+		}()
+	}
+
+	if err := validateURL(urlStr); err != nil {
+		return nil, err
+	}
+	if err := checkPaging(urlStr, opts); err != nil {
+		return nil, err
+	}
+
+	client := opts.Client
+	if client == nil {
+		client = newClient(opts)
+	}
+	setCookies(client, urlStr, opts.Cookies)
+
+	if opts.Transform != nil {
+		emit = transformEmit(emit, opts.Transform)
+	}
+	// Annotate before the transform so that it can use the page number
+	if opts.AnnotatePage != "" {
+		emit = annotateEmit(emit, opts.AnnotatePage, opts)
+	}
+
+	// Expand before annotating and transforming so that they see the children
+	if opts.ExpandKey != "" {
+		emit = expandEmit(ctx, client, urlStr, emit, opts)
+	}
+
+	// Stop on the entries as they come before anything else sees them
+	if opts.Until != nil {
+		emit = untilEmit(emit, opts.Until)
+		defer func() {
+			if errors.Is(err, errUntil) {
+				result, err = allEntries, nil
+			}
+		}()
+	}
+
+	// Fetch all pages at once if a HEAD request tells how many there are
+	if opts.ProbeHead && opts.paged() {
+		if lastPage := probeLastPage(ctx, client, urlStr, opts); lastPage > 0 {
+			err := fetchPages(ctx, client, urlStr, opts, emit, 1, lastPage)
+			return allEntries, err
+		}
+	}
+
+	if opts.Scroll {
+		err := scroll(ctx, client, urlStr, opts, emit)
+		return allEntries, err
+	}
+
+	plan, err := firstPage(ctx, client, urlStr, opts)
+	if err != nil {
+		return nil, err
+	}
+	entries, lastPage, count, nextLink := plan.entries, plan.Pages, plan.Count, plan.Next
+
+	if lastPage > 0 {
+		// Count the entries to check them against the count
+		fetched := 0
+		counted := func(page int, entries []any) error {
+			fetched += len(entries)
+			return emit(page, entries)
+		}
+		if err := counted(1, entries); err != nil {
+			return nil, err
+		}
+		if err := fetchPages(ctx, client, urlStr, opts, counted, 2, lastPage); err != nil || count == 0 {
+			return allEntries, err
+		}
+
+		// The number of pages assumes all are the size of the first one
+		if pageSize := opts.pageSize(entries); fetched < count-pageSize || fetched > count+pageSize {
+			opts.logf(0, "WARNING: Fetched %d entries but the count is %d", fetched, count)
+			if opts.CountFallback {
+				if err := fetchSequential(ctx, client, urlStr, opts, counted, lastPage+1, count-fetched); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return allEntries, nil
+	}
+
+	if err := emit(1, entries); err != nil {
+		return nil, err
+	}
+	if opts.StopOnEmpty && len(entries) == 0 {
+		return allEntries, nil
+	}
+	if plan.Mode == "sequential pages" {
+		err := fetchSequential(ctx, client, urlStr, opts, emit, 2, count-len(entries))
+		return allEntries, err
+	}
+
+	// Iterate using next Link
+	base := plan.base
+	for page := 2; nextLink != ""; page++ {
+		// Stop as soon as cancelled even if the server responds quickly
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := sleep(ctx, opts.Delay); err != nil {
+			return nil, err
+		}
+		// Relative links are relative to the page that had them
+		link, err := resolveLink(base, nextLink)
+		if err != nil {
+			return nil, err
+		}
+		linked, err := getLinkedPage(withPage(ctx, page), client, urlStr, link, opts)
+		if err != nil {
+			return nil, &PageError{Page: page, Err: err}
+		}
+		// The entries may not be there yet in eventually consistent stores
+		for retry := 0; len(linked.entries) == 0 && retry < opts.RetryEmpty; retry++ {
+			wait := backoff(retry, opts.RetryMaxWait)
+			opts.logf(1, "Retrying empty page %s in %v", link, wait)
+			if err := sleep(ctx, wait); err != nil {
+				return nil, err
+			}
+			if linked, err = getLinkedPage(withPage(ctx, page), client, urlStr, link, opts); err != nil {
+				return nil, &PageError{Page: page, Err: err}
+			}
+		}
+		nextLink, base = linked.next, linked.base
+
+		if err := emit(page, linked.entries); err != nil {
+			return nil, err
+		}
+		if opts.StopOnEmpty && len(linked.entries) == 0 {
+			break
+		}
+
+		// Fetch the rest concurrently as soon as a Link header has the last page
+		if linked.last != "" && nextLink != "" && opts.paged() {
+			_, lastPage, err := lastLinkPage(urlStr, base, linked.last, opts)
+			if err != nil {
+				return nil, err
+			}
+			if lastPage > page {
+				opts.logf(1, "Fetching pages %d to %d concurrently", page+1, lastPage)
+				err := fetchPages(ctx, client, urlStr, opts, emit, page+1, lastPage)
+				return allEntries, err
+			}
+		}
+	}
+	return allEntries, nil
+}
+
+// lastLinkPage resolves the last link against base and gets the number
+// of pages from it, or 0 if it has no page number as in urlStr
+func lastLinkPage(urlStr string, base *url.URL, link string, opts *Options) (string, int, error) {
+	link, err := resolveLink(base, link)
+	if err != nil {
+		return "", 0, err
+	}
+	lastURL, err := url.Parse(link)
+	if err != nil {
+		return "", 0, err
+	}
+	pages, err := opts.pageNumber(urlStr, lastURL)
+	if err != nil {
+		opts.logf(1, "No page number in last link %s", link)
+		return link, 0, nil
+	}
+	if opts.PageStride > 0 {
+		pages = pages/opts.PageStride + 1
+	}
+	return link, pages, nil
+}
+
+// linkedPage is a page fetched by following a link
+type linkedPage struct {
+	entries []any
+	// next and last are the links in the page, if any, with last
+	// only from the Link header
+	next string
+	last string
+	// base is the URL of the page after redirects to resolve the links
+	base *url.URL
+}
+
+// getLinkedPage fetches the page at link
+func getLinkedPage(ctx context.Context, client *http.Client, urlStr string, link string, opts *Options) (*linkedPage, error) {
+	resp, err := getPage(ctx, client, link, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	rawBody, err := decodeResponse(resp, opts)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := extractEntries(rawBody, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &linkedPage{entries: entries, base: resp.Request.URL}
+	body, isMap := rawBody.(map[string]any)
+	switch {
+	case isMap && opts.NextPageKey != "":
+		page.next, err = nextPageLink(urlStr, body, opts)
+	case isMap && opts.NextKey != "":
+		page.next, err = getLink(body, opts.NextKey, cmp.Or(opts.LinkHrefField, "href"))
+	default:
+		// Bare arrays have no keys so use the Link headers
+		page.next, page.last = getNextLastLinks(resp.Header.Get("Link"))
+	}
+	return page, err
+}
+
+// countEntries returns the total number of entries as counted in the first
+// page, or by fetching all the pages if there's no count and fallback is set
+func countEntries(ctx context.Context, urlStr string, opts *Options, fallback bool) (int, error) {
+	plan, err := dryRun(ctx, urlStr, opts)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case plan.Count > 0 || plan.Mode == "count key" || plan.Mode == "count header":
+		return plan.Count, nil
+	case plan.Mode == "single page":
+		return plan.Entries, nil
+	case !fallback:
+		return 0, fmt.Errorf("no count in the first page")
+	}
+
+	count := 0
+	options := *opts
+	options.Emit = func(_ int, entries []any) error {
+		count += len(entries)
+		return nil
+	}
+	_, err = unpage(ctx, urlStr, &options)
+	return count, err
+}
+
+// dryRun fetches only the first page and returns how the rest would be fetched
+func dryRun(ctx context.Context, urlStr string, opts *Options) (*Plan, error) {
+	if err := validateURL(urlStr); err != nil {
+		return nil, err
+	}
+	if err := checkPaging(urlStr, opts); err != nil {
+		return nil, err
+	}
+
+	client := opts.Client
+	if client == nil {
+		client = newClient(opts)
+	}
+	setCookies(client, urlStr, opts.Cookies)
+
+	plan, err := firstPage(ctx, client, urlStr, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ProbeHead && opts.paged() {
+		if lastPage := probeLastPage(ctx, client, urlStr, opts); lastPage > 0 {
+			plan.Mode, plan.Pages = "head", lastPage
+		}
+	}
+	return plan, nil
+}
+
+// parseHeaders sets the headers in the "Key: Value" lines, the later ones
+// replacing the earlier ones and those already in headers whatever their case
+func parseHeaders(headers map[string]string, lines []string, expandEnv bool) error {
+	for _, header := range lines {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid header: %s", header)
+		}
+		value := strings.TrimSpace(parts[1])
+		if expandEnv {
+			value = os.ExpandEnv(value)
+		}
+		headers[http.CanonicalHeaderKey(strings.TrimSpace(parts[0]))] = value
+	}
+	return nil
+}
+
+// readHeaderFile reads the "Key: Value" lines in file skipping blanks and comments
+func readHeaderFile(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var headers []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		headers = append(headers, line)
+	}
+	return headers, nil
+}
+
+// expandQuery expands the environment variables in the query values of the
+// URL, keeping the rest as is so that placeholders like {page} stay there
+func expandQuery(urlStr string) (string, error) {
+	if _, err := url.Parse(urlStr); err != nil {
+		return "", err
+	}
+	prefix, query, ok := strings.Cut(urlStr, "?")
+	if !ok || query == "" {
+		return urlStr, nil
+	}
+	query, fragment, hasFragment := strings.Cut(query, "#")
+	pairs := strings.Split(query, "&")
+	for i, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		value, err := url.QueryUnescape(value)
+		if err != nil {
+			return "", err
+		}
+		if !strings.Contains(value, "$") {
+			continue
+		}
+		pairs[i] = key + "=" + url.QueryEscape(os.ExpandEnv(value))
+	}
+	urlStr = prefix + "?" + strings.Join(pairs, "&")
+	if hasFragment {
+		urlStr += "#" + fragment
+	}
+	return urlStr, nil
+}
+
+// urlError records the URL whose pages failed
+type urlError struct {
+	URL string
+	Err error
+}
+
+func (e *urlError) Error() string {
+	return e.URL + ": " + e.Err.Error()
+}
+
+func (e *urlError) Unwrap() error {
+	return e.Err
+}
+
+func init() {
+	log.SetFlags(0)
+	log.SetPrefix("ERROR: ")
+}
+
+func main() {
+	var opts struct {
+		headers         []string
+		headerFile      string
+		userAgent       string
+		cookies         []string
+		maxRedirects    int
+		unixSocket      string
+		maxConnsPerHost int
+		retries         int
+		retryOn         []int
+		retryMaxWait    time.Duration
+		expandEnv       bool
+		jsonapi         bool
+		github          bool
+		dataKey         string
+		entryKey        string
+		singleObject    bool
+		expandKey       string
+		expandInto      string
+		summary         bool
+		profile         string
+		profilesFile    string
+		awsSigV4        string
+		countOnly       bool
+		noFallback      bool
+		perHostLimit    int
+		adaptiveRate    bool
+		rateRemaining   string
+		rateReset       string
+		logRequests     string
+		redactHeaders   []string
+		lastKey         string
+		scroll          bool
+		scrollIDKey     string
+		scrollURL       string
+		scrollTTL       string
+		gzipRequest     bool
+		nextKey         string
+		nextPageKey     string
+		linkHrefField   string
+		stopOnEmpty     bool
+		errorKey        string
+		contentType     string
+		responseNDJSON  bool
+		countKey        string
+		perPage         int
+		pageStride      int
+		preferPageSize  int
+		retryEmpty      int
+		minPageSize     int
+		bufferPages     int
+		countHeader     string
+		pagesHeader     string
+		probeHead       bool
+		countFallback   bool
+		paramPage       string
+		pageURLTemplate string
+		timeout         int
+		deadline        time.Duration
+		delay           time.Duration
+		cacheDir        string
+		continueOnError bool
+		retryFailed     time.Duration
+		failFast        bool
+		partial         bool
+		pick            []string
+		annotatePage    string
+		transform       string
+		until           string
+		stream          bool
+		meta            bool
+		csv             bool
+		csvFields       []string
+		group           bool
+		grouped         bool
+		pretty          bool
+		output          string
+		appendOutput    bool
+		jsonErrors      bool
+		trace           bool
+		batch           bool
+		dryRun          bool
+		jobs            int
+		verbose         int
+		version         bool
+	}
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] URL...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.StringSliceVarP(&opts.headers, "header", "H", nil, "HTTP header (may be specified multiple times")
+	flag.StringVarP(&opts.headerFile, "header-file", "", "", "file with HTTP headers, one per line")
+	flag.StringVarP(&opts.userAgent, "user-agent", "A", "unpage/"+version, "User-Agent header unless given with -H or --header-file")
+	flag.StringArrayVarP(&opts.cookies, "cookie", "b", nil, "cookie as \"name=value\" (may be specified multiple times)")
+	flag.StringVarP(&opts.unixSocket, "unix-socket", "", "", "connect through this Unix domain socket")
+	flag.IntVarP(&opts.maxConnsPerHost, "max-conns-per-host", "", 0, "maximum number of connections to each host (0 for no limit)")
+	flag.IntVarP(&opts.perHostLimit, "per-host-concurrency", "", 0, "maximum number of requests in flight to each host (0 for no limit other than the global one)")
+	flag.BoolVarP(&opts.adaptiveRate, "adaptive-rate", "", false, "keep the requests in flight under the remaining ones in the rate-limit headers, waiting for the reset when there are none left")
+	flag.StringVarP(&opts.rateRemaining, "rate-remaining-header", "", defaultRateRemainingHeader, "header with the remaining requests for --adaptive-rate")
+	flag.StringVarP(&opts.rateReset, "rate-reset-header", "", defaultRateResetHeader, "header with the seconds or Unix time when the rate limit resets for --adaptive-rate")
+	flag.IntVarP(&opts.retries, "retries", "", 0, "number of retries on network errors and the statuses in --retry-on")
+	flag.IntSliceVarP(&opts.retryOn, "retry-on", "", defaultRetryOn, "comma-separated HTTP statuses to retry")
+	flag.DurationVarP(&opts.retryMaxWait, "retry-max-wait", "", defaultRetryMaxWait, "maximum wait between retries")
+	flag.IntVarP(&opts.maxRedirects, "max-redirects", "", defaultMaxRedirects, "maximum number of redirects to follow (0 for none), keeping Authorization only on the same host or its subdomains")
+	flag.BoolVarP(&opts.expandEnv, "expand-env", "", false, "expand environment variables in header and query values")
+	flag.BoolVarP(&opts.jsonapi, "jsonapi", "", false, "use the data, links.next, links.last and meta.total keys of JSON:API")
+	flag.StringVarP(&opts.awsSigV4, "aws-sigv4", "", "", "sign the requests with AWS Signature Version 4 for \"region:service\" with the credentials in AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN")
+	flag.StringVarP(&opts.profile, "profile", "", "", "use the flags and headers of this profile in --profiles-file unless given")
+	flag.StringVarP(&opts.profilesFile, "profiles-file", "", "", "JSON file mapping profile names to their \"flags\" and \"headers\" (default unpage/profiles.json in the user config directory like ~/.config)")
+	flag.BoolVarP(&opts.github, "github", "", false, "use the GitHub API with the token in GITHUB_TOKEN, if set")
+	flag.StringVarP(&opts.dataKey, "data-key", "D", "", "key to access the data in the JSON response")
+	flag.StringVarP(&opts.entryKey, "entry-key", "", "", "key to access each entry within the elements of the data")
+	flag.StringVarP(&opts.expandKey, "expand-key", "", "", "field with a link in each entry to fetch all its pages from (experimental)")
+	flag.StringVarP(&opts.expandInto, "expand-into", "", "", "field to store the entries fetched with --expand-key instead of the link")
+	flag.BoolVarP(&opts.singleObject, "single-object", "", false, "take the value of --data-key, or the response without it, as the only entry if it's not an array")
+	flag.StringVarP(&opts.nextKey, "next-key", "N", "", "key to access the next page link in the JSON response")
+	flag.StringVarP(&opts.nextPageKey, "next-page-key", "", "", "key to access the next page number in the JSON response")
+	flag.StringVarP(&opts.contentType, "content-type", "", "auto", "decode the responses as \"json\" or \"ndjson\" whatever their Content-Type or \"auto\" to fail those that aren't JSON")
+	flag.BoolVarP(&opts.responseNDJSON, "response-ndjson", "", false, "decode each line of the responses as an entry, same as --content-type ndjson")
+	flag.StringVarP(&opts.errorKey, "error-key", "", "", "key with an error in JSON responses with a 200 status")
+	flag.BoolVarP(&opts.stopOnEmpty, "stop-on-empty", "", false, "stop following the next links at the first empty page")
+	flag.StringVarP(&opts.linkHrefField, "link-href-field", "", "href", "field with the link when the next or last key is an object")
+	flag.StringVarP(&opts.lastKey, "last-key", "L", "", "key to access the last page link in the JSON response")
+	flag.StringVarP(&opts.countKey, "count-key", "C", "", "key to access the total number of entries in the JSON response")
+	flag.IntVarP(&opts.perPage, "per-page", "", 0, "number of entries in each page to get the number of pages from the count")
+	flag.IntVarP(&opts.pageStride, "page-stride", "", 0, "send (page-1) times this in --param-page, e.g. 100 for 0, 100, 200...")
+	flag.IntVarP(&opts.preferPageSize, "prefer-page-size", "", 0, "ask OData servers for this many entries in each page with Prefer: odata.maxpagesize")
+	flag.IntVarP(&opts.retryEmpty, "retry-empty", "", 0, "number of times to fetch an empty page from a next link again before taking it as empty")
+	flag.IntVarP(&opts.minPageSize, "min-page-size", "", 0, "fetch the pages sequentially if the first one has less entries than this, unless --per-page is given")
+	flag.StringVarP(&opts.countHeader, "count-header", "", "", "header with the total number of entries")
+	flag.StringVarP(&opts.pagesHeader, "total-pages-header", "", "", "header with the total number of pages")
+	flag.BoolVarP(&opts.probeHead, "probe-head", "", false, "get the total number of pages with a HEAD request from --total-pages-header, or --count-header with --per-page")
+	flag.BoolVarP(&opts.countFallback, "count-fallback", "", false, "fetch more pages sequentially if there are less entries than counted")
+	flag.BoolVarP(&opts.scroll, "scroll", "", false, "use the Elasticsearch scroll API with the search in the URL query")
+	flag.StringVarP(&opts.scrollIDKey, "scroll-id-key", "", defaultScrollIDKey, "key to access the scroll id in the JSON response")
+	flag.StringVarP(&opts.scrollURL, "scroll-url", "", defaultScrollURL, "URL to get the next batch of results from a scroll")
+	flag.StringVarP(&opts.scrollTTL, "scroll-ttl", "", defaultScrollTTL, "how long to keep the scroll context alive between requests")
+	flag.BoolVarP(&opts.gzipRequest, "gzip-request", "", false, "compress the scroll ids posted by --scroll with gzip")
+	flag.StringVarP(&opts.paramPage, "param-page", "P", "", "parameter that represents the page number")
+	flag.StringVarP(&opts.pageURLTemplate, "page-url-template", "", "", "URL with {page} replaced with the page number, instead of a URL argument and --param-page")
+	flag.IntVarP(&opts.timeout, "timeout", "t", 60, "timeout in seconds for each request")
+	flag.DurationVarP(&opts.deadline, "deadline", "", 0, "deadline for the whole operation")
+	flag.DurationVarP(&opts.delay, "delay", "", 0, "delay between sequential requests or batches of concurrent ones")
+	flag.StringVarP(&opts.cacheDir, "cache-dir", "", "", "directory to cache pages and revalidate them with ETag or Last-Modified")
+	flag.BoolVarP(&opts.continueOnError, "continue-on-error", "", false, "output the pages fetched and report the failed ones")
+	flag.DurationVarP(&opts.retryFailed, "retry-failed-timeout", "", 0, "fetch the pages that failed with --continue-on-error again one at a time at the end with this timeout for each request")
+	flag.BoolVarP(&opts.failFast, "fail-fast", "", true, "abort on the first page that fails")
+	flag.BoolVarP(&opts.partial, "partial", "", false, "output the entries fetched before an error")
+	flag.StringSliceVarP(&opts.pick, "pick", "", nil, "dot-path field to keep in each entry (may be specified multiple times)")
+	flag.StringVarP(&opts.annotatePage, "annotate-page", "", "", "set this field (_page if not given) to the page number in each entry")
+	flag.Lookup("annotate-page").NoOptDefVal = "_page"
+	flag.StringVarP(&opts.transform, "transform", "", "", "jq expression to transform each entry")
+	flag.StringVarP(&opts.until, "until", "", "", "stop at the first entry matching \"FIELD OP VALUE\" with OP one of eq, ne, lt, le, gt, ge")
+	flag.BoolVarP(&opts.stream, "stream", "", false, "write the entries as the pages arrive")
+	flag.IntVarP(&opts.bufferPages, "buffer-pages", "", 0, "write the entries every this many pages, fetching no further ahead, instead of at the end")
+	flag.BoolVarP(&opts.meta, "meta", "", false, "wrap the entries in an object with the count, pages and URL")
+	flag.BoolVarP(&opts.csv, "csv", "", false, "write the entries as CSV")
+	flag.StringSliceVarP(&opts.csvFields, "csv-fields", "", nil, "comma-separated fields to write as CSV columns")
+	flag.BoolVarP(&opts.group, "group", "", false, "write an object mapping each URL to its entries")
+	flag.BoolVarP(&opts.grouped, "grouped", "", false, "write an object mapping each page number to its entries, null for failed pages")
+	flag.BoolVarP(&opts.summary, "summary", "", false, "write the number of entries and pages fetched and how long it took to stderr")
+	flag.BoolVarP(&opts.pretty, "pretty", "", false, "indent the JSON output")
+	flag.StringVarP(&opts.output, "output", "o", "", "write the output to this file instead of stdout")
+	flag.BoolVarP(&opts.appendOutput, "append", "", false, "append the lines of --batch or the entries to the JSON array in the --output file")
+	flag.BoolVarP(&opts.batch, "batch", "", false, "read \"URL [FLAGS]\" lines from stdin and write a JSON result line for each")
+	flag.IntVarP(&opts.jobs, "jobs", "", 4, "number of URLs fetched at once with --batch")
+	flag.BoolVarP(&opts.dryRun, "dry-run", "", false, "fetch only the first page and print how the rest would be fetched")
+	flag.BoolVarP(&opts.countOnly, "count-only", "", false, "print the number of entries from the count in the first page, or fetching all pages if there's none")
+	flag.BoolVarP(&opts.noFallback, "no-fallback", "", false, "fail with --count-only if there's no count in the first page instead of fetching all pages")
+	flag.BoolVarP(&opts.jsonErrors, "json-errors", "", false, "report errors as JSON objects on stderr")
+	flag.BoolVarP(&opts.trace, "trace", "", false, "log the timings of each request")
+	flag.StringVarP(&opts.logRequests, "log-requests", "", "", "append a JSON line for each request with its headers, status, bytes and duration to this file")
+	flag.StringSliceVarP(&opts.redactHeaders, "redact-header", "", nil, "header to redact in --log-requests besides Authorization, Proxy-Authorization and Cookie (may be specified multiple times)")
+	flag.CountVarP(&opts.verbose, "verbose", "v", "log requests (-v), headers (-vv) and full dumps (-vvv)")
+	flag.BoolVarP(&opts.version, "version", "", false, "print version and exit")
+	flag.Parse()
+
+	if opts.version {
+		fmt.Printf("unpage v%s %v %s/%s\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+		os.Exit(0)
+	}
+	// The profile may set any flag, even --github or --jsonapi, so apply it
+	// and the presets before the flags that depend on others are checked
+	var profileHeaders []string
+	if opts.profile != "" {
+		file := cmp.Or(opts.profilesFile, defaultProfilesFile())
+		var err error
+		if profileHeaders, err = applyProfile(flag.CommandLine, file, opts.profile); err != nil {
+			log.Print(err)
+			os.Exit(1)
+		}
+	}
+	if opts.jsonapi && opts.github {
+		log.Print("--github and --jsonapi are mutually exclusive")
+		os.Exit(1)
+	}
+	var presetHeaders map[string]string
+	if opts.github || opts.jsonapi {
+		name := "github"
+		if opts.jsonapi {
+			name = "jsonapi"
+		}
+		var err error
+		if presetHeaders, err = applyPreset(flag.CommandLine, name); err != nil {
+			log.Print(err)
+			os.Exit(1)
+		}
+	}
+	// Writing in chunks is streaming with fewer pages in memory
+	if opts.bufferPages > 0 {
+		if opts.appendOutput || opts.batch || opts.csv || len(opts.csvFields) > 0 || opts.group || opts.grouped || opts.meta || opts.pretty {
+			log.Print("--buffer-pages can't be used with --append, --batch, --csv, --group, --grouped, --meta or --pretty")
+			os.Exit(1)
+		}
+		opts.stream = true
+	}
+	if opts.pretty && (opts.stream || opts.csv || len(opts.csvFields) > 0 || opts.batch) {
+		log.Print("--pretty can't be used with --batch, --csv or --stream")
+		os.Exit(1)
+	}
+	if opts.responseNDJSON {
+		if flag.CommandLine.Changed("content-type") && opts.contentType != "ndjson" {
+			log.Print("--content-type and --response-ndjson are mutually exclusive")
+			os.Exit(1)
+		}
+		opts.contentType = "ndjson"
+	}
+	if !slices.Contains([]string{"auto", "json", "ndjson"}, opts.contentType) {
+		log.Printf("Invalid --content-type: %s", opts.contentType)
+		os.Exit(1)
+	}
+	if opts.appendOutput {
+		if opts.output == "" {
+			log.Print("--append requires --output")
+			os.Exit(1)
+		}
+		if opts.csv || len(opts.csvFields) > 0 || opts.dryRun || opts.group || opts.grouped || opts.meta || opts.stream {
+			log.Print("--append only works with --batch or the JSON array output")
+			os.Exit(1)
+		}
+	}
+	if opts.noFallback && !opts.countOnly {
+		log.Print("--no-fallback requires --count-only")
+		os.Exit(1)
+	}
+	if opts.countOnly && (opts.batch || opts.dryRun) {
+		log.Print("--count-only can't be used with --batch or --dry-run")
+		os.Exit(1)
+	}
+	if opts.summary && (opts.batch || opts.dryRun) {
+		log.Print("--summary can't be used with --batch or --dry-run")
+		os.Exit(1)
+	}
+	if opts.expandInto != "" && opts.expandKey == "" {
+		log.Print("--expand-into requires --expand-key")
+		os.Exit(1)
+	}
+	if opts.batch {
+		if opts.dryRun {
+			log.Print("--batch and --dry-run are mutually exclusive")
+			os.Exit(1)
+		}
+		if flag.NArg() > 0 || opts.pageURLTemplate != "" {
+			log.Print("--batch reads the URLs from stdin")
+			os.Exit(1)
+		}
+		if opts.stream || opts.meta || opts.csv || len(opts.csvFields) > 0 || opts.group || opts.grouped {
+			log.Print("--batch writes JSON lines and can't be used with --csv, --group, --grouped, --meta or --stream")
+			os.Exit(1)
+		}
+	} else if flag.NArg() == 0 && opts.pageURLTemplate == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if opts.continueOnError && flag.CommandLine.Changed("fail-fast") && opts.failFast {
+		log.Print("--continue-on-error and --fail-fast are mutually exclusive")
+		os.Exit(1)
+	}
+	if opts.retryFailed > 0 {
+		if !opts.continueOnError && opts.failFast {
+			log.Print("--retry-failed-timeout requires --continue-on-error")
+			os.Exit(1)
+		}
+		if opts.bufferPages > 0 {
+			log.Print("--retry-failed-timeout can't be used with --buffer-pages")
+			os.Exit(1)
+		}
+	}
+	if len(opts.csvFields) > 0 {
+		opts.csv = true
+	}
+	if (opts.meta && opts.stream) || (opts.csv && (opts.meta || opts.stream)) {
+		log.Print("--csv, --meta and --stream are mutually exclusive")
+		os.Exit(1)
+	}
+	if opts.meta && flag.NArg() > 1 {
+		log.Print("--meta only works with a single URL")
+		os.Exit(1)
+	}
+	if opts.group && (opts.meta || opts.stream || opts.csv) {
+		log.Print("--group, --csv, --meta and --stream are mutually exclusive")
+		os.Exit(1)
+	}
+	if opts.grouped {
+		if opts.group || opts.meta || opts.stream || opts.csv {
+			log.Print("--grouped can't be used with --csv, --group, --meta or --stream")
+			os.Exit(1)
+		}
+		if flag.NArg() > 1 {
+			log.Print("--grouped only works with a single URL")
+			os.Exit(1)
+		}
+	}
+	urls := flag.Args()
+	if opts.pageURLTemplate != "" {
+		if len(urls) > 0 {
+			log.Print("--page-url-template is the URL to fetch")
+			os.Exit(1)
+		}
+		if opts.paramPage != "" {
+			log.Print("--page-url-template and --param-page are mutually exclusive")
+			os.Exit(1)
+		}
+		if !strings.Contains(opts.pageURLTemplate, pagePlaceholder) {
+			log.Printf("No %s in --page-url-template: %s", pagePlaceholder, opts.pageURLTemplate)
+			os.Exit(1)
+		}
+		urls = []string{opts.pageURLTemplate}
+	}
+	for _, urlStr := range urls {
+		if err := validateURL(urlStr); err != nil {
+			log.Print(err)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if opts.maxRedirects < 0 {
+		log.Print("--max-redirects can't be negative")
+		os.Exit(1)
+	}
+
+	if os.Getenv("DEBUG") != "" {
+		opts.verbose = 3
+	}
+
+	headers := map[string]string{
+		"Accept":     "application/json",
+		"User-Agent": opts.userAgent,
+	}
+	for key, value := range presetHeaders {
+		headers[key] = value
+	}
+	// Headers given with -H take precedence over those in the file
+	// and these over those in the profile
+	lines := opts.headers
+	if opts.headerFile != "" {
+		fileHeaders, err := readHeaderFile(opts.headerFile)
+		if err != nil {
+			log.Print(err)
+			os.Exit(1)
+		}
+		lines = append(fileHeaders, lines...)
+	}
+	lines = append(profileHeaders, lines...)
+	if err := parseHeaders(headers, lines, opts.expandEnv); err != nil {
 		log.Print(err)
 		os.Exit(1)
 	}
-	fmt.Println(string(output))
+	if opts.expandEnv {
+		for i := range urls {
+			var err error
+			if urls[i], err = expandQuery(urls[i]); err != nil {
+				log.Print(err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	sum := newSummary()
+	timeout := time.Duration(opts.timeout) * time.Second
+	// Cancel on the first interrupt, so that --partial writes what was fetched,
+	// and leave the next one to kill the process
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
+	cancel := func() {}
+	if opts.deadline > 0 {
+		ctx, cancel = context.WithTimeout(ctx, opts.deadline)
+	}
+	defer cancel()
+
+	options := &Options{
+		Headers:            headers,
+		ParamPage:          opts.paramPage,
+		DataKey:            opts.dataKey,
+		EntryKey:           opts.entryKey,
+		SingleObject:       opts.singleObject,
+		ExpandKey:          opts.expandKey,
+		ExpandInto:         opts.expandInto,
+		NextKey:            opts.nextKey,
+		NextPageKey:        opts.nextPageKey,
+		LastKey:            opts.lastKey,
+		LinkHrefField:      opts.linkHrefField,
+		StopOnEmpty:        opts.stopOnEmpty,
+		ErrorKey:           opts.errorKey,
+		ContentType:        opts.contentType,
+		Scroll:             opts.scroll,
+		ScrollIDKey:        opts.scrollIDKey,
+		ScrollURL:          opts.scrollURL,
+		ScrollTTL:          opts.scrollTTL,
+		GzipRequest:        opts.gzipRequest,
+		CountKey:           opts.countKey,
+		PerPage:            opts.perPage,
+		PageStride:         opts.pageStride,
+		PreferPageSize:     opts.preferPageSize,
+		RetryEmpty:         opts.retryEmpty,
+		MinPageSize:        opts.minPageSize,
+		BufferPages:        opts.bufferPages,
+		CountHeader:        opts.countHeader,
+		TotalPagesHeader:   opts.pagesHeader,
+		ProbeHead:          opts.probeHead,
+		CountFallback:      opts.countFallback,
+		Timeout:            timeout,
+		Delay:              opts.delay,
+		CacheDir:           opts.cacheDir,
+		ContinueOnError:    opts.continueOnError || !opts.failFast,
+		RetryFailedTimeout: opts.retryFailed,
+		Partial:            opts.partial,
+		MaxRedirects:       opts.maxRedirects,
+		NoRedirects:        opts.maxRedirects == 0,
+		UnixSocket:         opts.unixSocket,
+		MaxConnsPerHost:    opts.maxConnsPerHost,
+		Retries:            opts.retries,
+		RetryOn:            opts.retryOn,
+		RetryMaxWait:       opts.retryMaxWait,
+		Pick:               opts.pick,
+		AnnotatePage:       opts.annotatePage,
+		Verbose:            opts.verbose,
+		Logger:             log.New(os.Stderr, "", 0),
+	}
+	if opts.pageURLTemplate != "" {
+		options.PagePlaceholder = pagePlaceholder
+	}
+	if opts.transform != "" {
+		transform, err := compileTransform(opts.transform)
+		if err != nil {
+			log.Printf("Invalid transform: %v", err)
+			os.Exit(1)
+		}
+		options.Transform = transform
+	}
+	if opts.until != "" {
+		until, err := parseUntil(opts.until)
+		if err != nil {
+			log.Printf("Invalid --until: %v", err)
+			os.Exit(1)
+		}
+		options.Until = until
+	}
+
+	if opts.awsSigV4 != "" {
+		region, service, ok := strings.Cut(opts.awsSigV4, ":")
+		if !ok || region == "" || service == "" {
+			log.Printf("Invalid --aws-sigv4: %s", opts.awsSigV4)
+			os.Exit(1)
+		}
+		sign, err := awsSigV4(region, service)
+		if err != nil {
+			log.Print(err)
+			os.Exit(1)
+		}
+		options.Sign = sign
+	}
+
+	var wrappers []func(http.RoundTripper) http.RoundTripper
+	if opts.trace {
+		wrappers = append(wrappers, func(transport http.RoundTripper) http.RoundTripper {
+			return &traceTransport{base: transport, logger: options.Logger}
+		})
+	}
+	if opts.logRequests != "" {
+		file, err := os.OpenFile(opts.logRequests, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			log.Print(err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		wrappers = append(wrappers, func(transport http.RoundTripper) http.RoundTripper {
+			return newRequestLogTransport(transport, file, opts.redactHeaders)
+		})
+	}
+	if wrappers != nil {
+		options.WrapTransport = func(transport http.RoundTripper) http.RoundTripper {
+			for _, wrap := range wrappers {
+				transport = wrap(transport)
+			}
+			return transport
+		}
+	}
+
+	// Share the client and the limit on concurrent requests across URLs
+	options.Client = newClient(options)
+	// Set for each URL as it's fetched, even those read by --batch
+	for _, cookie := range opts.cookies {
+		cookies, err := parseCookies(cookie)
+		if err != nil {
+			log.Print(err)
+			os.Exit(1)
+		}
+		options.Cookies = append(options.Cookies, cookies...)
+	}
+	options.Limiter = semaphore.NewWeighted(concurrency)
+	if opts.perHostLimit > 0 {
+		options.HostLimiter = NewHostLimiter(opts.perHostLimit)
+	}
+	if opts.adaptiveRate {
+		options.RateThrottle = NewRateThrottle(opts.rateRemaining, opts.rateReset)
+	}
+
+	// report logs the error for urlStr, prefixing the URL when there are several
+	report := func(urlStr string, err error) {
+		if opts.jsonErrors {
+			writeJSONError(os.Stderr, urlStr, err)
+		} else if len(urls) > 1 {
+			log.Printf("%s: %v", urlStr, err)
+		} else {
+			log.Print(err)
+		}
+	}
+	fail := func(err error) {
+		if uerr, ok := err.(*urlError); ok {
+			report(uerr.URL, uerr.Err)
+		} else {
+			report(urls[0], err)
+		}
+		os.Exit(1)
+	}
+
+	// The JSON array is appended at the end, the rest is written as it comes
+	out := os.Stdout
+	if opts.output != "" && (!opts.appendOutput || opts.batch) {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if opts.appendOutput {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		file, err := os.OpenFile(opts.output, flags, 0o644)
+		if err != nil {
+			log.Print(err)
+			os.Exit(1)
+		}
+		out = file
+	}
+
+	if opts.dryRun {
+		enc := json.NewEncoder(out)
+		if opts.pretty {
+			enc.SetIndent("", "  ")
+		}
+		for _, urlStr := range urls {
+			plan, err := dryRun(ctx, urlStr, options)
+			if err != nil {
+				fail(&urlError{URL: urlStr, Err: err})
+			}
+			if err := enc.Encode(plan); err != nil {
+				fail(err)
+			}
+		}
+		if err := out.Close(); err != nil {
+			fail(err)
+		}
+		return
+	}
+
+	if opts.countOnly {
+		for _, urlStr := range urls {
+			count, err := countEntries(ctx, urlStr, options, !opts.noFallback)
+			if err != nil {
+				fail(&urlError{URL: urlStr, Err: err})
+			}
+			fmt.Fprintln(out, count)
+		}
+		if err := out.Close(); err != nil {
+			fail(err)
+		}
+		return
+	}
+
+	if opts.batch {
+		err := runBatch(ctx, os.Stdin, out, options, opts.jobs)
+		if err == nil {
+			err = out.Close()
+		}
+		if err != nil {
+			log.Print(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var stream *arrayWriter
+	if opts.stream {
+		stream = newArrayWriter(out)
+		stream.flushPages = opts.bufferPages
+	}
+
+	collectors := make([]*collector, len(urls))
+	partials := make([]*PartialError, len(urls))
+	g, gctx := errgroup.WithContext(ctx)
+	if stream != nil {
+		// Fetch one URL at a time to keep the order
+		g.SetLimit(1)
+	}
+	for i, urlStr := range urls {
+		collectors[i] = newCollector()
+		if opts.grouped {
+			collectors[i].byPage = make(pageGroups)
+		}
+		options := *options
+		if stream != nil {
+			options.Emit = stream.write
+		} else {
+			options.Emit = collectors[i].write
+		}
+		if opts.summary {
+			options.Emit = sum.count(options.Emit)
+		}
+		g.Go(func() error {
+			_, err := unpage(gctx, urlStr, &options)
+			if errors.As(err, &partials[i]) {
+				return nil
+			}
+			if err != nil {
+				return &urlError{URL: urlStr, Err: err}
+			}
+			return nil
+		})
+	}
+
+	err := g.Wait()
+	if err != nil && !opts.partial {
+		fail(err)
+	}
+
+	collect := newCollector()
+	for _, c := range collectors {
+		collect.entries = append(collect.entries, c.entries...)
+		collect.pages += c.pages
+	}
+
+	if stream != nil {
+		if err := stream.close(); err != nil {
+			log.Print(err)
+			os.Exit(1)
+		}
+	} else if opts.csv {
+		if err := writeCSV(out, collect.entries, opts.csvFields); err != nil {
+			log.Print(err)
+			os.Exit(1)
+		}
+	} else {
+		var results any = collect.entries
+		if opts.meta {
+			results = &metaOutput{
+				Count: len(collect.entries),
+				Pages: collect.pages,
+				URL:   urls[0],
+				Items: collect.entries,
+			}
+		} else if opts.group {
+			group := make(map[string][]any, len(urls))
+			for i, urlStr := range urls {
+				group[urlStr] = collectors[i].entries
+			}
+			results = group
+		} else if opts.grouped {
+			results = collectors[0].byPage
+		}
+		marshal := json.Marshal
+		if opts.pretty {
+			marshal = func(v any) ([]byte, error) {
+				return json.MarshalIndent(v, "", "  ")
+			}
+		}
+		if opts.appendOutput {
+			if err := appendArray(opts.output, collect.entries, marshal); err != nil {
+				log.Print(err)
+				os.Exit(1)
+			}
+		} else {
+			output, err := marshal(results)
+			if err != nil {
+				log.Print(err)
+				os.Exit(1)
+			}
+			fmt.Fprintln(out, string(output))
+		}
+	}
+	if err := out.Close(); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+	if opts.summary {
+		// The failed pages are passed without entries
+		for _, partial := range partials {
+			if partial != nil {
+				sum.pages -= len(partial.Failed)
+			}
+		}
+		fmt.Fprintln(os.Stderr, sum)
+	}
+
+	if err != nil {
+		fail(err)
+	}
+	failed := false
+	for i, partial := range partials {
+		if partial == nil {
+			continue
+		}
+		for _, e := range partial.Failed {
+			report(urls[i], e)
+		}
+		if !opts.jsonErrors {
+			report(urls[i], partial)
+		}
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
 }
@@ -1,17 +1,44 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
+// numbers returns the entries decoded from the JSON numbers in values
+func numbers(values ...int) []any {
+	entries := make([]any, len(values))
+	for i, value := range values {
+		entries[i] = json.Number(strconv.Itoa(value))
+	}
+	return entries
+}
+
 func TestUnpage_SinglePage(t *testing.T) {
 	// Mock single page response
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -31,13 +58,13 @@ func TestUnpage_SinglePage(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	headers := map[string]string{}
-	paramPage := "page"
-	dataKey := "data"
-	nextKey := ""
-	lastKey := ""
+	opts := &Options{
+		ParamPage: "page",
+		DataKey:   "data",
+		Timeout:   5 * time.Second,
+	}
 
-	entries, err := unpage(ctx, server.URL, headers, paramPage, dataKey, nextKey, lastKey, 5)
+	entries, err := unpage(ctx, server.URL, opts)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -47,6 +74,126 @@ func TestUnpage_SinglePage(t *testing.T) {
 	}
 }
 
+func TestUnpage_LargeNumbers(t *testing.T) {
+	const body = `{"data":[{"id":1234567890123456789,"score":0.5}],"total":1}`
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		ParamPage: "page",
+		DataKey:   "data",
+		CountKey:  "total",
+		Timeout:   5 * time.Second,
+	}
+
+	entries, err := unpage(ctx, server.URL, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	output, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if expected := `[{"id":1234567890123456789,"score":0.5}]`; string(output) != expected {
+		t.Errorf("got %s; want %s", output, expected)
+	}
+}
+
+func TestMaybeJSON(t *testing.T) {
+	tests := []struct {
+		contentType string
+		expected    bool
+	}{
+		{"", true},
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"application/vnd.api+json", true},
+		{"text/plain; charset=utf-8", true},
+		{"text/html; charset=utf-8", false},
+		{"application/xml", false},
+		{"invalid;;", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.contentType, func(t *testing.T) {
+			if result := maybeJSON(test.contentType); result != test.expected {
+				t.Errorf("maybeJSON(%q) = %v; want %v", test.contentType, result, test.expected)
+			}
+		})
+	}
+}
+
+func TestUnpage_ContentType(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `[1, 2]`)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{Timeout: 5 * time.Second}
+	if _, err := unpage(ctx, server.URL, opts); err == nil || !strings.Contains(err.Error(), `"text/html"`) || !strings.Contains(err.Error(), "--content-type json") {
+		t.Errorf("Expected Content-Type error, got %v", err)
+	}
+
+	opts.ContentType = "json"
+	entries, err := unpage(ctx, server.URL, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(entries, numbers(1, 2)) {
+		t.Errorf("Unexpected entries: %v", entries)
+	}
+}
+
+func TestUnpage_ResponseNDJSON(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if r.URL.Query().Get("page") == "" {
+			w.Header().Set("Link", `</?page=2>; rel="next"`)
+			fmt.Fprint(w, "{\"id\":1}\n{\"id\":2}\n\n{\"id\":3}\n")
+			return
+		}
+		fmt.Fprint(w, `{"id":4}`)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		ContentType: "ndjson",
+		Timeout:     5 * time.Second,
+	}
+
+	entries, err := unpage(ctx, server.URL, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []any{
+		map[string]any{"id": json.Number("1")},
+		map[string]any{"id": json.Number("2")},
+		map[string]any{"id": json.Number("3")},
+		map[string]any{"id": json.Number("4")},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Unexpected entries: %v", entries)
+	}
+}
+
 func TestUnpage_ErrorResponse(t *testing.T) {
 	// Mock error response
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -60,13 +207,13 @@ func TestUnpage_ErrorResponse(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	headers := map[string]string{}
-	paramPage := "page"
-	dataKey := "data"
-	nextKey := ""
-	lastKey := ""
+	opts := &Options{
+		ParamPage: "page",
+		DataKey:   "data",
+		Timeout:   5 * time.Second,
+	}
 
-	_, err := unpage(ctx, server.URL, headers, paramPage, dataKey, nextKey, lastKey, 5)
+	_, err := unpage(ctx, server.URL, opts)
 	if err == nil {
 		t.Fatalf("Expected error, got none")
 	}
@@ -104,13 +251,13 @@ func TestUnpage_PaginationViaLinkHeaders(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	headers := map[string]string{}
-	paramPage := "page"
-	dataKey := "data"
-	nextKey := ""
-	lastKey := ""
+	opts := &Options{
+		ParamPage: "page",
+		DataKey:   "data",
+		Timeout:   5 * time.Second,
+	}
 
-	entries, err := unpage(ctx, server.URL, headers, paramPage, dataKey, nextKey, lastKey, 5)
+	entries, err := unpage(ctx, server.URL, opts)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -120,6 +267,40 @@ func TestUnpage_PaginationViaLinkHeaders(t *testing.T) {
 	}
 }
 
+func TestUnpage_LastLinkWithoutParamPage(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("p"))
+		page = max(page, 1)
+		if page < 10 {
+			w.Header().Set("Link", fmt.Sprintf(`</?p=%d>; rel="next", </?p=10>; rel="last"`, page+1))
+		}
+		json.NewEncoder(w).Encode([]any{page})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, paramPage := range []string{"", "page"} {
+		t.Run(paramPage, func(t *testing.T) {
+			opts := &Options{
+				ParamPage: paramPage,
+				Timeout:   5 * time.Second,
+			}
+
+			entries, err := unpage(ctx, server.URL, opts)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if len(entries) != 10 {
+				t.Fatalf("Expected 10 entries, got %d", len(entries))
+			}
+		})
+	}
+}
+
 func TestUnpage_MultiplePages(t *testing.T) {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
@@ -163,17 +344,18 @@ func TestUnpage_MultiplePages(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	headers := map[string]string{}
-	paramPage := "page"
-	dataKey := "data"
-	nextKey := "links.next"
-	lastKey := ""
+	opts := &Options{
+		ParamPage: "page",
+		DataKey:   "data",
+		NextKey:   "links.next",
+		Timeout:   5 * time.Second,
+	}
 
 	// Construct a full base URL for the test
 	baseURL := server.URL
 
 	// Run the unpage function
-	entries, err := unpage(ctx, baseURL, headers, paramPage, dataKey, nextKey, lastKey, 5)
+	entries, err := unpage(ctx, baseURL, opts)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -184,6 +366,57 @@ func TestUnpage_MultiplePages(t *testing.T) {
 	}
 }
 
+func TestUnpage_NextPageKey(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("q") != "x" {
+			t.Errorf("Expected query to be kept, got %q", r.URL.RawQuery)
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		var next any
+		switch page {
+		case 1:
+			next = 3
+		case 3:
+			next = "4"
+		case 4:
+			next = 0
+		default:
+			t.Errorf("Unexpected page number: %d", page)
+		}
+		data := map[string]any{
+			"data": []any{page},
+			"meta": map[string]any{"next_page": next},
+		}
+		json.NewEncoder(w).Encode(data)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		ParamPage:   "page",
+		DataKey:     "data",
+		NextPageKey: "meta.next_page",
+		Timeout:     5 * time.Second,
+	}
+
+	entries, err := unpage(ctx, server.URL+"?q=x", opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(entries, numbers(1, 3, 4)) {
+		t.Errorf("Unexpected entries: %v", entries)
+	}
+
+	opts.ParamPage = ""
+	if _, err := unpage(ctx, server.URL, opts); err == nil {
+		t.Errorf("Expected error without paramPage")
+	}
+}
+
 func TestUnpage_WithLastKey(t *testing.T) {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
@@ -243,17 +476,19 @@ func TestUnpage_WithLastKey(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	headers := map[string]string{}
-	paramPage := "page"
-	dataKey := "data"
-	nextKey := "links.next"
-	lastKey := "links.last"
+	opts := &Options{
+		ParamPage: "page",
+		DataKey:   "data",
+		NextKey:   "links.next",
+		LastKey:   "links.last",
+		Timeout:   5 * time.Second,
+	}
 
 	// Construct a full base URL for the test
 	baseURL := server.URL
 
 	// Run the unpage function
-	entries, err := unpage(ctx, baseURL, headers, paramPage, dataKey, nextKey, lastKey, 5)
+	entries, err := unpage(ctx, baseURL, opts)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -264,107 +499,2130 @@ func TestUnpage_WithLastKey(t *testing.T) {
 	}
 }
 
-func TestGetNestedValue(t *testing.T) {
-	data := map[string]any{
-		"foo": map[string]any{
-			"bar": map[string]any{
-				"baz": "value",
-			},
-		},
+func TestUnpage_CountKey(t *testing.T) {
+	var requests atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		entries := []any{(page-1)*2 + 1, (page-1)*2 + 2}
+		if page == 3 {
+			entries = entries[:1]
+		}
+		data := map[string]any{
+			"data":  entries,
+			"total": "5",
+		}
+		json.NewEncoder(w).Encode(data)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		ParamPage: "page",
+		DataKey:   "data",
+		CountKey:  "total",
+		Timeout:   5 * time.Second,
 	}
 
-	tests := []struct {
-		key      string
-		expected any
-	}{
-		{"foo.bar.baz", "value"},
-		{"foo.bar", map[string]any{"baz": "value"}},
-		{"foo", map[string]any{"bar": map[string]any{"baz": "value"}}},
-		{"foo.baz", nil}, // key does not exist
-		{"not_existing", nil},
+	entries, err := unpage(ctx, server.URL, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(entries, numbers(1, 2, 3, 4, 5)) {
+		t.Errorf("Expected 5 entries in order, got %v", entries)
 	}
+	if requests.Load() != 3 {
+		t.Errorf("Expected 3 requests, got %d", requests.Load())
+	}
+}
 
-	for _, test := range tests {
-		t.Run(test.key, func(t *testing.T) {
-			result := getNestedValue(data, test.key)
+func TestUnpage_PerPage(t *testing.T) {
+	// Page 1 is short, the rest have 10 entries up to 25
+	var requests atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		n := min(10, 25-(page-1)*10)
+		if page == 1 {
+			n = 5
+		}
+		data := map[string]any{
+			"data":  make([]any, n),
+			"total": 25,
+		}
+		json.NewEncoder(w).Encode(data)
+	})
 
-			if !reflect.DeepEqual(result, test.expected) {
-				t.Errorf("getNestedValue(%q) = %v; want %v", test.key, result, test.expected)
-			}
-		})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		ParamPage: "page",
+		DataKey:   "data",
+		CountKey:  "total",
+		PerPage:   10,
+		Timeout:   5 * time.Second,
+	}
+
+	entries, err := unpage(ctx, server.URL, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(entries) != 20 {
+		t.Errorf("Expected 20 entries, got %d", len(entries))
+	}
+	if requests.Load() != 3 {
+		t.Errorf("Expected 3 requests, got %d", requests.Load())
 	}
 }
-func TestGetNextLastLinks(t *testing.T) {
+
+func TestUnpage_PageStride(t *testing.T) {
+	// 5 entries, 2 at a time starting at the offset in start
+	var mu sync.Mutex
+	var starts []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := r.URL.Query().Get("start")
+		mu.Lock()
+		starts = append(starts, start)
+		mu.Unlock()
+		offset, _ := strconv.Atoi(start)
+		var data []any
+		for i := offset; i < min(offset+2, 5); i++ {
+			data = append(data, i)
+		}
+		if r.URL.Path == "/link" {
+			w.Header().Set("Link", `</link?start=4>; rel="last"`)
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": data, "total": 5})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
 	tests := []struct {
-		header       string
-		expectedNext string
-		expectedLast string
+		path     string
+		countKey string
 	}{
-		{
-			header:       `<https://example.com/page/2>; rel="next", <https://example.com/page/10>; rel="last"`,
-			expectedNext: "https://example.com/page/2",
-			expectedLast: "https://example.com/page/10",
-		},
-		{
-			header:       `<https://example.com/page/5>; rel="next"`,
-			expectedNext: "https://example.com/page/5",
-			expectedLast: "",
-		},
-		{
-			header:       `<https://example.com/page/5>; rel="last"`,
-			expectedNext: "",
-			expectedLast: "https://example.com/page/5",
-		},
-		{
-			header:       "",
-			expectedNext: "",
-			expectedLast: "",
-		},
-		{
-			header:       `<https://example.com/page/2>; rel="next", <https://example.com/page/5>; rel="prev"`,
-			expectedNext: "https://example.com/page/2",
-			expectedLast: "",
-		},
+		{"/count", "total"},
+		{"/link", ""},
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.header, func(t *testing.T) {
-			next, last := getNextLastLinks(tt.header)
-			if next != tt.expectedNext {
-				t.Errorf("expected next %q, got %q", tt.expectedNext, next)
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			starts = nil
+			opts := &Options{
+				ParamPage:  "start",
+				PageStride: 2,
+				DataKey:    "data",
+				CountKey:   test.countKey,
+				Timeout:    5 * time.Second,
 			}
-			if last != tt.expectedLast {
-				t.Errorf("expected last %q, got %q", tt.expectedLast, last)
+			entries, err := unpage(ctx, server.URL+test.path, opts)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if expected := numbers(0, 1, 2, 3, 4); !reflect.DeepEqual(entries, expected) {
+				t.Errorf("Expected %v, got %v", expected, entries)
+			}
+			sort.Strings(starts)
+			if expected := []string{"0", "2", "4"}; !reflect.DeepEqual(starts, expected) {
+				t.Errorf("Expected starts %v, got %v", expected, starts)
 			}
 		})
 	}
 }
 
-func TestGetPage(t *testing.T) {
+func TestUnpage_PagePlaceholder(t *testing.T) {
+	// 3 pages at /{mode}/page/N?per_page=1
+	var mu sync.Mutex
+	var paths []string
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, `{"key": "value"}`)
+		mode, value, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/page/")
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		page, err := strconv.Atoi(value)
+		if err != nil || page > 3 {
+			http.NotFound(w, r)
+			return
+		}
+		switch mode {
+		case "link":
+			w.Header().Set("Link", `</link/page/3?per_page=1>; rel="last"`)
+		case "pages":
+			w.Header().Set("X-Total-Pages", "3")
+		case "next":
+			if page < 3 {
+				w.Header().Set("Link", fmt.Sprintf(`</next/page/%d?per_page=1>; rel="next"`, page+1))
+			}
+		}
+		json.NewEncoder(w).Encode([]any{page})
 	})
 
 	server := httptest.NewServer(handler)
 	defer server.Close()
 
-	ctx := context.Background()
-	urlStr := server.URL
-	headers := map[string]string{}
-	params := map[string]string{}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	client := &http.Client{
-		Timeout: time.Duration(1) * time.Second,
+	for _, mode := range []string{"link", "pages", "next"} {
+		t.Run(mode, func(t *testing.T) {
+			paths = nil
+			opts := &Options{
+				PagePlaceholder:  "{page}",
+				TotalPagesHeader: "X-Total-Pages",
+				Timeout:          5 * time.Second,
+			}
+			entries, err := unpage(ctx, server.URL+"/"+mode+"/page/{page}?per_page=1", opts)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if expected := numbers(1, 2, 3); !reflect.DeepEqual(entries, expected) {
+				t.Errorf("Expected %v, got %v", expected, entries)
+			}
+			sort.Strings(paths)
+			expected := []string{"/" + mode + "/page/1", "/" + mode + "/page/2", "/" + mode + "/page/3"}
+			if !reflect.DeepEqual(paths, expected) {
+				t.Errorf("Expected %v, got %v", expected, paths)
+			}
+		})
 	}
 
-	resp, err := getPage(ctx, client, urlStr, headers, params)
-	if err != nil {
-		t.Fatalf("getPage returned an error: %v", err)
+	tests := []struct {
+		name string
+		url  string
+		opts *Options
+	}{
+		{"no placeholder", server.URL + "/link/page/1", &Options{PagePlaceholder: "{page}"}},
+		{"param page", server.URL + "/link/page/{page}", &Options{PagePlaceholder: "{page}", ParamPage: "page"}},
 	}
-	defer resp.Body.Close()
-
-	var result map[string]any
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := unpage(ctx, test.url, test.opts); err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
+
+func TestUnpage_PreferPageSize(t *testing.T) {
+	// An OData service with 5 entries that applies the preference
+	// unless told not to
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefer := r.Header.Get("Prefer")
+		if prefer != "return=minimal, odata.maxpagesize=2" {
+			http.Error(w, "Prefer: "+prefer, http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("ignore") == "" {
+			w.Header().Set("Preference-Applied", "odata.maxpagesize=2")
+		}
+		skip, _ := strconv.Atoi(r.URL.Query().Get("$skip"))
+		data := map[string]any{"value": numbers(skip, skip+1)[:min(2, 5-skip)]}
+		if skip+2 < 5 {
+			q := r.URL.Query()
+			q.Set("$skip", strconv.Itoa(skip+2))
+			data["@odata.nextLink"] = "?" + q.Encode()
+		}
+		json.NewEncoder(w).Encode(data)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		query string
+		log   string
+	}{
+		{"", "Preference-Applied: odata.maxpagesize=2"},
+		{"?ignore=1", "WARNING: The server didn't apply odata.maxpagesize=2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			var buf strings.Builder
+			opts := &Options{
+				Headers:        map[string]string{"Prefer": "return=minimal"},
+				DataKey:        "value",
+				NextKey:        "@odata.nextLink",
+				PreferPageSize: 2,
+				Timeout:        5 * time.Second,
+				Verbose:        1,
+				Logger:         log.New(&buf, "", 0),
+			}
+			entries, err := unpage(ctx, server.URL+test.query, opts)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if expected := numbers(0, 1, 2, 3, 4); !reflect.DeepEqual(entries, expected) {
+				t.Errorf("Expected %v, got %v", expected, entries)
+			}
+			if !strings.Contains(buf.String(), test.log) {
+				t.Errorf("Expected %q in the log, got %q", test.log, buf.String())
+			}
+		})
+	}
+}
+
+func TestUnpage_MinPageSize(t *testing.T) {
+	// Page 1 has a single entry by mistake, the rest have 2 up to 5
+	var requests atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		data := []any{}
+		switch page {
+		case 1:
+			data = []any{1}
+		case 2:
+			data = []any{2, 3}
+		case 3:
+			data = []any{4, 5}
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"data":  data,
+			"total": 5,
+		})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name        string
+		minPageSize int
+		perPage     int
+		expected    []any
+		requests    int32
+	}{
+		{"concurrent", 0, 0, numbers(1, 2, 3, 4, 5), 5},
+		{"sequential", 2, 0, numbers(1, 2, 3, 4, 5), 3},
+		{"per page", 2, 2, numbers(1, 2, 3, 4, 5), 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests.Store(0)
+			opts := &Options{
+				ParamPage:   "page",
+				DataKey:     "data",
+				CountKey:    "total",
+				MinPageSize: tt.minPageSize,
+				PerPage:     tt.perPage,
+				Timeout:     5 * time.Second,
+			}
+			entries, err := unpage(ctx, server.URL, opts)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(entries, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, entries)
+			}
+			if requests.Load() != tt.requests {
+				t.Errorf("Expected %d requests, got %d", tt.requests, requests.Load())
+			}
+		})
+	}
+}
+
+func TestUnpage_BufferPages(t *testing.T) {
+	// Page 2 is slow so the rest would pile up waiting for it
+	const lastPage, bufferPages = 20, 3
+	var requests, emitted, ahead atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1) - emitted.Load()
+		for {
+			if m := ahead.Load(); n <= m || ahead.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 2 {
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.Header().Set("Link", fmt.Sprintf("</?page=%d>; rel=\"last\"", lastPage))
+		json.NewEncoder(w).Encode([]any{page})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var pages []int
+	opts := &Options{
+		ParamPage:   "page",
+		BufferPages: bufferPages,
+		Timeout:     5 * time.Second,
+		Emit: func(page int, entries []any) error {
+			emitted.Add(1)
+			pages = append(pages, page)
+			return nil
+		},
+	}
+
+	if _, err := unpage(ctx, server.URL, opts); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(pages) != lastPage || !sort.IntsAreSorted(pages) {
+		t.Errorf("Expected pages 1 to %d in order, got %v", lastPage, pages)
+	}
+	if ahead.Load() > bufferPages {
+		t.Errorf("Expected at most %d pages ahead, got %d", bufferPages, ahead.Load())
+	}
+}
+
+func TestUnpage_ProbeHead(t *testing.T) {
+	var heads, gets atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probe := r.Header.Get("X-Probe")
+		if probe == "yes" {
+			w.Header().Set("X-Total-Pages", "3")
+		}
+		// Only the HEAD request has the count when probing for it
+		if probe != "count" || r.Method == http.MethodHead {
+			w.Header().Set("X-Total-Count", "5")
+		}
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+			return
+		}
+		gets.Add(1)
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		entries := []any{page, page}
+		if page == 3 {
+			entries = entries[:1]
+		}
+		json.NewEncoder(w).Encode(entries)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name    string
+		probe   string
+		perPage int
+	}{
+		{"probe", "yes", 0},
+		{"probe count", "count", 2},
+		{"fallback", "no", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			heads.Store(0)
+			gets.Store(0)
+			opts := &Options{
+				Headers:          map[string]string{"X-Probe": test.probe},
+				ParamPage:        "page",
+				CountHeader:      "X-Total-Count",
+				TotalPagesHeader: "X-Total-Pages",
+				PerPage:          test.perPage,
+				ProbeHead:        true,
+				Timeout:          5 * time.Second,
+			}
+
+			entries, err := unpage(ctx, server.URL, opts)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(entries, numbers(1, 1, 2, 2, 3)) {
+				t.Errorf("Unexpected entries: %v", entries)
+			}
+			if heads.Load() != 1 || gets.Load() != 3 {
+				t.Errorf("Expected 1 HEAD and 3 GET requests, got %d and %d", heads.Load(), gets.Load())
+			}
+		})
+	}
+}
+
+func TestUnpage_PartialDeadline(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 3 {
+			// Hang until the client gives up
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Link", `</?page=4>; rel="last"`)
+		json.NewEncoder(w).Encode([]any{page})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	opts := &Options{
+		ParamPage: "page",
+		Timeout:   5 * time.Second,
+		Partial:   true,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	entries, err := unpage(ctx, server.URL, opts)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the deadline to stop the requests, took %v", elapsed)
+	}
+	if !reflect.DeepEqual(entries, numbers(1, 2, 4)) {
+		t.Errorf("Expected the entries fetched before the deadline, got %v", entries)
+	}
+}
+
+func TestUnpage_Cookies(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := r.URL.Query().Get("page")
+		if page == "1" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+		} else if cookie, err := r.Cookie("session"); err != nil || cookie.Value != "abc" {
+			http.Error(w, "login required", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Link", `</?page=3>; rel="last"`)
+		json.NewEncoder(w).Encode([]any{page})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		ParamPage: "page",
+		Timeout:   5 * time.Second,
+	}
+
+	entries, err := unpage(ctx, server.URL, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("Expected 3 entries, got %d", len(entries))
+	}
+}
+
+func TestParseCookies(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+		wantErr  bool
+	}{
+		{"session=abc", []string{"session=abc"}, false},
+		{"a=1; b=x=y", []string{"a=1", "b=x=y"}, false},
+		{"empty=", []string{"empty="}, false},
+		{"novalue", nil, true},
+		{"=value", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			cookies, err := parseCookies(test.input)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseCookies(%q) error = %v; wantErr %v", test.input, err, test.wantErr)
+			}
+			var result []string
+			for _, cookie := range cookies {
+				result = append(result, cookie.Name+"="+cookie.Value)
+			}
+			if !reflect.DeepEqual(result, test.expected) {
+				t.Errorf("parseCookies(%q) = %v; want %v", test.input, result, test.expected)
+			}
+		})
+	}
+}
+
+func TestUnpage_MaxRedirects(t *testing.T) {
+	var target *httptest.Server
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/r/"))
+		if n > 0 {
+			// Redirect to the same host name on another port
+			http.Redirect(w, r, fmt.Sprintf("%s/r/%d", target.URL, n-1), http.StatusFound)
+			return
+		}
+		json.NewEncoder(w).Encode([]any{r.Header.Get("Authorization")})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	target = httptest.NewServer(handler)
+	defer target.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		maxRedirects int
+		noRedirects  bool
+		redirects    int
+		wantErr      bool
+	}{
+		{0, false, 10, false},
+		{0, false, 11, true},
+		{2, false, 2, false},
+		{2, false, 3, true},
+		{0, true, 0, false},
+		{0, true, 1, true},
+		{2, true, 1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d/%v/%d", test.maxRedirects, test.noRedirects, test.redirects), func(t *testing.T) {
+			opts := &Options{
+				Headers:      map[string]string{"Authorization": "Bearer token"},
+				MaxRedirects: test.maxRedirects,
+				NoRedirects:  test.noRedirects,
+				Timeout:      5 * time.Second,
+			}
+			entries, err := unpage(ctx, fmt.Sprintf("%s/r/%d", server.URL, test.redirects), opts)
+			if test.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "redirects at "+target.URL+"/r/") {
+					t.Errorf("Expected error naming the location, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(entries, []any{"Bearer token"}) {
+				t.Errorf("Expected Authorization to be kept, got %v", entries)
+			}
+		})
+	}
+}
+
+func TestUnpage_UnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "unpage.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("Unix sockets not supported: %v", err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]any{r.Host, r.URL.Path})
+	})
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		Timeout:    5 * time.Second,
+		UnixSocket: socket,
+	}
+
+	entries, err := unpage(ctx, "http://docker/containers/json", opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(entries, []any{"docker", "/containers/json"}) {
+		t.Errorf("Unexpected entries: %v", entries)
+	}
+}
+
+func TestUnpage_Limiter(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		w.Header().Set("Link", `</?page=10>; rel="last"`)
+		json.NewEncoder(w).Encode([]any{r.URL.Query().Get("page")})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Two URLs sharing the client and the limit
+	opts := &Options{
+		ParamPage: "page",
+		Client:    &http.Client{Timeout: 5 * time.Second},
+		Limiter:   semaphore.NewWeighted(3),
+	}
+	g, ctx := errgroup.WithContext(ctx)
+	for range 2 {
+		g.Go(func() error {
+			entries, err := unpage(ctx, server.URL, opts)
+			if err == nil && len(entries) != 10 {
+				err = fmt.Errorf("expected 10 entries, got %d", len(entries))
+			}
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if maxInFlight.Load() > 3 {
+		t.Errorf("Expected at most 3 requests in flight, got %d", maxInFlight.Load())
+	}
+}
+
+func TestUnpage_HostLimiter(t *testing.T) {
+	// Two hosts, counting the requests in flight to each and in total
+	var total, maxTotal atomic.Int32
+	track := func(inFlight, maxInFlight *atomic.Int32) {
+		n := inFlight.Add(1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+	}
+	newServer := func(inFlight, maxInFlight *atomic.Int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			track(inFlight, maxInFlight)
+			track(&total, &maxTotal)
+			defer inFlight.Add(-1)
+			defer total.Add(-1)
+			time.Sleep(10 * time.Millisecond)
+			w.Header().Set("Link", `</?page=10>; rel="last"`)
+			json.NewEncoder(w).Encode([]any{r.URL.Query().Get("page")})
+		}))
+	}
+	var inFlight1, maxInFlight1, inFlight2, maxInFlight2 atomic.Int32
+	server1 := newServer(&inFlight1, &maxInFlight1)
+	defer server1.Close()
+	server2 := newServer(&inFlight2, &maxInFlight2)
+	defer server2.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		ParamPage:   "page",
+		Client:      &http.Client{Timeout: 5 * time.Second},
+		Limiter:     semaphore.NewWeighted(3),
+		HostLimiter: NewHostLimiter(2),
+	}
+	g, ctx := errgroup.WithContext(ctx)
+	for _, urlStr := range []string{server1.URL, server1.URL, server2.URL} {
+		g.Go(func() error {
+			entries, err := unpage(ctx, urlStr, opts)
+			if err == nil && len(entries) != 10 {
+				err = fmt.Errorf("expected 10 entries, got %d", len(entries))
+			}
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if maxInFlight1.Load() > 2 || maxInFlight2.Load() > 2 {
+		t.Errorf("Expected at most 2 requests in flight to each host, got %d and %d", maxInFlight1.Load(), maxInFlight2.Load())
+	}
+	if maxTotal.Load() > 3 {
+		t.Errorf("Expected at most 3 requests in flight, got %d", maxTotal.Load())
+	}
+}
+
+func TestUnpage_CountMismatch(t *testing.T) {
+	// 20 entries with a larger first page: 4 + 8 pages of 2
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		var entries []any
+		switch {
+		case page == 1:
+			entries = []any{1, 2, 3, 4}
+		case page <= 9:
+			entries = []any{page*2 + 1, page*2 + 2}
+		default:
+			entries = []any{}
+		}
+		data := map[string]any{
+			"data":  entries,
+			"total": 20,
+		}
+		json.NewEncoder(w).Encode(data)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		fallback bool
+		expected int
+	}{
+		{false, 12},
+		{true, 20},
+	}
+
+	for _, test := range tests {
+		t.Run(strconv.FormatBool(test.fallback), func(t *testing.T) {
+			var buf strings.Builder
+			opts := &Options{
+				ParamPage:     "page",
+				DataKey:       "data",
+				CountKey:      "total",
+				CountFallback: test.fallback,
+				Timeout:       5 * time.Second,
+				Logger:        log.New(&buf, "", 0),
+			}
+
+			entries, err := unpage(ctx, server.URL, opts)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if len(entries) != test.expected {
+				t.Errorf("Expected %d entries, got %d", test.expected, len(entries))
+			}
+			if !strings.Contains(buf.String(), "WARNING: Fetched 12 entries but the count is 20") {
+				t.Errorf("Expected warning, got %q", buf.String())
+			}
+		})
+	}
+}
+
+func TestUnpage_ContinueOnError(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 3 {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Link", `</?page=4>; rel="last"`)
+		data := map[string]any{
+			"data": []any{
+				map[string]any{"id": page},
+			},
+		}
+		json.NewEncoder(w).Encode(data)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		ParamPage: "page",
+		DataKey:   "data",
+		Timeout:   5 * time.Second,
+	}
+
+	// Fail fast by default
+	_, err := unpage(ctx, server.URL, opts)
+	var pageErr *PageError
+	if !errors.As(err, &pageErr) || pageErr.Page != 3 {
+		t.Fatalf("Expected page 3 to fail, got %v", err)
+	}
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("Expected status 500, got %v", err)
+	}
+
+	opts.ContinueOnError = true
+	entries, err := unpage(ctx, server.URL, opts)
+	var partial *PartialError
+	if !errors.As(err, &partial) {
+		t.Fatalf("Expected PartialError, got %v", err)
+	}
+	if len(partial.Failed) != 1 || partial.Failed[0].Page != 3 {
+		t.Fatalf("Expected page 3 to fail, got %v", partial.Failed)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+}
+
+func TestUnpage_RetryFailedTimeout(t *testing.T) {
+	// Page 3 is too slow the first time and page 5 always fails
+	var slow atomic.Bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		page = max(page, 1)
+		switch page {
+		case 3:
+			if !slow.Swap(true) {
+				time.Sleep(300 * time.Millisecond)
+			}
+		case 5:
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Link", `</?page=6>; rel="last"`)
+		json.NewEncoder(w).Encode([]any{page})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var pages []int
+	opts := &Options{
+		ParamPage:          "page",
+		Timeout:            100 * time.Millisecond,
+		ContinueOnError:    true,
+		RetryFailedTimeout: 5 * time.Second,
+		Emit: func(page int, entries []any) error {
+			pages = append(pages, page)
+			return nil
+		},
+	}
+
+	_, err := unpage(ctx, server.URL, opts)
+	var partial *PartialError
+	if !errors.As(err, &partial) {
+		t.Fatalf("Expected PartialError, got %v", err)
+	}
+	if len(partial.Failed) != 1 || partial.Failed[0].Page != 5 {
+		t.Fatalf("Expected page 5 to fail, got %v", partial.Failed)
+	}
+	if expected := []int{1, 2, 3, 4, 5, 6}; !reflect.DeepEqual(pages, expected) {
+		t.Errorf("Expected the pages in order %v, got %v", expected, pages)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	requests := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		data := map[string]any{"data": []any{1, 2}, "total": 10}
+		switch r.URL.Path {
+		case "/link":
+			w.Header().Set("Link", `</link?page=2>; rel="next", </link?page=5>; rel="last"`)
+		case "/next":
+			data["next"] = "/next?page=2"
+		}
+		json.NewEncoder(w).Encode(data)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		path     string
+		opts     Options
+		expected Plan
+	}{
+		{
+			path:     "/link",
+			opts:     Options{ParamPage: "page"},
+			expected: Plan{Mode: "last link", Pages: 5, Next: server.URL + "/link?page=2", Last: server.URL + "/link?page=5", Entries: 2},
+		},
+		{
+			path:     "/count",
+			opts:     Options{ParamPage: "page", CountKey: "total"},
+			expected: Plan{Mode: "count key", Pages: 5, Count: 10, Entries: 2},
+		},
+		{
+			path:     "/count",
+			opts:     Options{ParamPage: "page", CountKey: "total", MinPageSize: 3},
+			expected: Plan{Mode: "sequential pages", Count: 10, Entries: 2},
+		},
+		{
+			path:     "/next",
+			opts:     Options{NextKey: "next"},
+			expected: Plan{Mode: "next key", Next: server.URL + "/next?page=2", Entries: 2},
+		},
+		{
+			path:     "/single",
+			expected: Plan{Mode: "single page", Entries: 2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			requests = 0
+			opts := test.opts
+			opts.DataKey = "data"
+			opts.Timeout = 5 * time.Second
+			plan, err := dryRun(ctx, server.URL+test.path, &opts)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			test.expected.URL = server.URL + test.path
+			plan.entries, plan.base = nil, nil
+			if !reflect.DeepEqual(*plan, test.expected) {
+				t.Errorf("got %+v; want %+v", *plan, test.expected)
+			}
+			if requests != 1 {
+				t.Errorf("Expected 1 request, got %d", requests)
+			}
+		})
+	}
+}
+
+func TestCountEntries(t *testing.T) {
+	var requests atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		data := map[string]any{"data": []any{1, 2}, "total": 10}
+		switch r.URL.Path {
+		case "/next":
+			// Three pages without a count
+			delete(data, "total")
+			if page, _ := strconv.Atoi(cmp.Or(r.URL.Query().Get("page"), "1")); page < 3 {
+				data["next"] = fmt.Sprintf("/next?page=%d", page+1)
+			}
+		case "/header":
+			delete(data, "total")
+			w.Header().Set("X-Total-Count", "7")
+		}
+		json.NewEncoder(w).Encode(data)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name     string
+		path     string
+		opts     Options
+		fallback bool
+		expected int
+		requests int32
+		wantErr  bool
+	}{
+		{"count key", "/count", Options{CountKey: "total", ParamPage: "page"}, true, 10, 1, false},
+		{"count key without pages", "/count", Options{CountKey: "total"}, false, 10, 1, false},
+		{"count header", "/header", Options{CountHeader: "X-Total-Count", NextKey: "next"}, false, 7, 1, false},
+		{"single page", "/single", Options{}, false, 2, 1, false},
+		{"fallback", "/next", Options{NextKey: "next"}, true, 6, 4, false},
+		{"no fallback", "/next", Options{NextKey: "next"}, false, 0, 1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests.Store(0)
+			opts := test.opts
+			opts.DataKey = "data"
+			opts.Timeout = 5 * time.Second
+			count, err := countEntries(ctx, server.URL+test.path, &opts, test.fallback)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Expected error %v, got %v", test.wantErr, err)
+			}
+			if count != test.expected {
+				t.Errorf("Expected %d, got %d", test.expected, count)
+			}
+			if requests.Load() != test.requests {
+				t.Errorf("Expected %d requests, got %d", test.requests, requests.Load())
+			}
+		})
+	}
+}
+
+func TestUnpage_RelativeLastLink(t *testing.T) {
+	var requests atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old/items", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/api/v2/items?"+r.URL.RawQuery, http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/api/v2/items", func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		// Relative to the path after the redirect
+		w.Header().Set("Link", `<items?page=4>; rel="last"`)
+		json.NewEncoder(w).Encode([]any{page})
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		ParamPage: "page",
+		Timeout:   5 * time.Second,
+	}
+
+	plan, err := dryRun(ctx, server.URL+"/old/items", opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if plan.Pages != 4 || plan.Last != server.URL+"/api/v2/items?page=4" {
+		t.Errorf("Expected 4 pages up to the resolved last link, got %+v", plan)
+	}
+
+	requests.Store(0)
+	entries, err := unpage(ctx, server.URL+"/old/items", opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(entries, numbers(1, 2, 3, 4)) {
+		t.Errorf("Unexpected entries: %v", entries)
+	}
+	if requests.Load() != 4 {
+		t.Errorf("Expected 4 requests, got %d", requests.Load())
+	}
+}
+
+func TestUnpage_RelativeNextLinks(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/items" {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		page := r.URL.Query().Get("page")
+		switch page {
+		case "":
+			w.Header().Set("Link", `<./items?page=2>; rel="next"`)
+		case "2":
+			w.Header().Set("Link", `<?page=3>; rel="next"`)
+		}
+		json.NewEncoder(w).Encode([]any{page})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		Timeout: 5 * time.Second,
+	}
+
+	entries, err := unpage(ctx, server.URL+"/api/items", opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(entries, []any{"", "2", "3"}) {
+		t.Errorf("Expected all pages, got %v", entries)
+	}
+}
+
+func TestUnpage_Delay(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		page = max(page, 1)
+		if page < 3 {
+			w.Header().Set("Link", fmt.Sprintf(`</?page=%d>; rel="next"`, page+1))
+		}
+		json.NewEncoder(w).Encode([]any{page})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		Timeout: 5 * time.Second,
+		Delay:   50 * time.Millisecond,
+	}
+
+	start := time.Now()
+	entries, err := unpage(ctx, server.URL, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+	if elapsed := time.Since(start); elapsed < 2*opts.Delay {
+		t.Errorf("Expected at least %v between requests, took %v", opts.Delay, elapsed)
+	}
+}
+
+func TestSleep(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	if err := sleep(ctx, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected sleep to be cancelled, took %v", elapsed)
+	}
+
+	if err := sleep(context.Background(), time.Millisecond); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestOrderedEmitter(t *testing.T) {
+	var order []int
+	emitter := newOrderedEmitter(func(page int, entries []any) error {
+		order = append(order, page)
+		return nil
+	}, 1)
+
+	for _, page := range []int{3, 1, 4, 2, 6, 5} {
+		if err := emitter.add(page, nil); err != nil {
+			t.Fatalf("add returned an error: %v", err)
+		}
+	}
+
+	if !reflect.DeepEqual(order, []int{1, 2, 3, 4, 5, 6}) {
+		t.Errorf("Expected pages in order, got %v", order)
+	}
+	if len(emitter.pending) != 0 {
+		t.Errorf("Expected no pending pages, got %d", len(emitter.pending))
+	}
+}
+
+func TestUnpage_OrderWithShuffledLatencies(t *testing.T) {
+	const lastPage, pageSize = 20, 3
+	delays := rand.Perm(lastPage)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		// Make the pages arrive in random order
+		time.Sleep(time.Duration(delays[page-1]) * time.Millisecond)
+		w.Header().Set("Link", fmt.Sprintf("</?page=%d>; rel=\"last\"", lastPage))
+		entries := make([]any, pageSize)
+		for i := range entries {
+			entries[i] = map[string]any{"id": (page-1)*pageSize + i}
+		}
+		json.NewEncoder(w).Encode(entries)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		ParamPage: "page",
+		Timeout:   5 * time.Second,
+	}
+
+	entries, err := unpage(ctx, server.URL, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(entries) != lastPage*pageSize {
+		t.Fatalf("Expected %d entries, got %d", lastPage*pageSize, len(entries))
+	}
+	for i, entry := range entries {
+		if id := entry.(map[string]any)["id"]; id != json.Number(strconv.Itoa(i)) {
+			t.Fatalf("Expected id %d at index %d, got %v", i, i, id)
+		}
+	}
+}
+
+func TestUnpage_Emit(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		w.Header().Set("Link", `</?page=5>; rel="last"`)
+		data := map[string]any{
+			"data": []any{page},
+		}
+		json.NewEncoder(w).Encode(data)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var emitted []any
+	opts := &Options{
+		ParamPage: "page",
+		DataKey:   "data",
+		Timeout:   5 * time.Second,
+		Emit: func(page int, entries []any) error {
+			emitted = append(emitted, entries...)
+			return nil
+		},
+	}
+
+	entries, err := unpage(ctx, server.URL, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if entries != nil {
+		t.Errorf("Expected no entries returned, got %v", entries)
+	}
+	if !reflect.DeepEqual(emitted, numbers(1, 2, 3, 4, 5)) {
+		t.Errorf("Expected entries in page order, got %v", emitted)
+	}
+}
+
+func TestUnpage_StreamCancelled(t *testing.T) {
+	// Page 3 hangs until the request is cancelled
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 3 {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Link", `</?page=3>; rel="last"`)
+		json.NewEncoder(w).Encode([]any{page})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var buf bytes.Buffer
+	w := newArrayWriter(&buf)
+	opts := &Options{
+		ParamPage: "page",
+		Partial:   true,
+		Timeout:   5 * time.Second,
+		Emit: func(page int, entries []any) error {
+			if page == 2 {
+				cancel()
+			}
+			return w.write(page, entries)
+		},
+	}
+
+	if _, err := unpage(ctx, server.URL, opts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatalf("close returned an error: %v", err)
+	}
+	var entries []any
+	if err := json.Unmarshal(buf.Bytes(), &entries); err != nil {
+		t.Fatalf("Expected a valid JSON array, got %q: %v", buf.String(), err)
+	}
+	if expected := []any{1.0, 2.0}; !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected %v, got %v", expected, entries)
+	}
+}
+
+func TestGetNestedValue(t *testing.T) {
+	data := map[string]any{
+		"foo": map[string]any{
+			"bar": map[string]any{
+				"baz": "value",
+			},
+		},
+		"@odata.nextLink": "next",
+	}
+
+	tests := []struct {
+		key      string
+		expected any
+	}{
+		{"foo.bar.baz", "value"},
+		{"foo.bar", map[string]any{"baz": "value"}},
+		{"foo", map[string]any{"bar": map[string]any{"baz": "value"}}},
+		{"foo.baz", nil}, // key does not exist
+		{"not_existing", nil},
+		{"@odata.nextLink", "next"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			result := getNestedValue(data, test.key)
+
+			if !reflect.DeepEqual(result, test.expected) {
+				t.Errorf("getNestedValue(%q) = %v; want %v", test.key, result, test.expected)
+			}
+		})
+	}
+}
+
+func TestGetInt(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    any
+		expected int
+		wantErr  bool
+	}{
+		{"int", 42, 42, false},
+		{"float", 42.0, 42, false},
+		{"json.Number", json.Number("4231"), 4231, false},
+		{"string", "4231", 4231, false},
+		{"string with spaces", " 7 ", 7, false},
+		{"negative string", "-3", -3, false},
+		{"non-numeric string", "many", 0, true},
+		{"float string", "4.5", 0, true},
+		{"whole json.Number", json.Number("100.0"), 100, false},
+		{"exponent json.Number", json.Number("1e3"), 1000, false},
+		{"invalid json.Number", json.Number("4.5"), 0, true},
+		{"bool", true, 0, true},
+		{"missing", nil, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := map[string]any{"meta": map[string]any{}}
+			if test.value != nil {
+				data["meta"].(map[string]any)["total"] = test.value
+			}
+			result, err := getInt(data, "meta.total")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("getInt(%v) error = %v; wantErr %v", test.value, err, test.wantErr)
+			}
+			if result != test.expected {
+				t.Errorf("getInt(%v) = %d; want %d", test.value, result, test.expected)
+			}
+		})
+	}
+}
+
+func TestGetLink(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     any
+		hrefField string
+		expected  string
+		wantErr   bool
+	}{
+		{"string", "/?page=2", "href", "/?page=2", false},
+		{"null", nil, "href", "", false},
+		{"href", map[string]any{"href": "/?page=2"}, "href", "/?page=2", false},
+		{"custom field", map[string]any{"url": "/?page=2"}, "url", "/?page=2", false},
+		{"missing field", map[string]any{"url": "/?page=2"}, "href", "", true},
+		{"number", 2.0, "href", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := map[string]any{"_links": map[string]any{"next": test.value}}
+			result, err := getLink(data, "_links.next", test.hrefField)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("Expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("getLink(%v) = %q; want %q", test.value, result, test.expected)
+			}
+		})
+	}
+}
+
+func TestUnpage_CancelNextLinks(t *testing.T) {
+	var requests atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		w.Header().Set("Link", fmt.Sprintf(`</?page=%d>; rel="next"`, page+1))
+		json.NewEncoder(w).Encode([]any{page})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Cancel after the second page of an endless list
+	opts := &Options{
+		Timeout: 5 * time.Second,
+		Emit: func(page int, _ []any) error {
+			if page == 2 {
+				cancel()
+			}
+			return nil
+		},
+	}
+
+	start := time.Now()
+	_, err := unpage(ctx, server.URL+"/?page=1", opts)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected to return promptly, took %v", elapsed)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("Expected 2 requests, got %d", n)
+	}
+}
+
+func TestUnpage_StopOnEmpty(t *testing.T) {
+	// Page 2 is empty but page 3 isn't
+	pages := map[string][]any{"1": {1}, "2": {}, "3": {3}}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page < 3 {
+			w.Header().Set("Link", fmt.Sprintf(`</?page=%d>; rel="next"`, page+1))
+		}
+		json.NewEncoder(w).Encode(pages[strconv.Itoa(page)])
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		stopOnEmpty bool
+		expected    []any
+	}{
+		{false, numbers(1, 3)},
+		{true, numbers(1)},
+	}
+
+	for _, test := range tests {
+		t.Run(strconv.FormatBool(test.stopOnEmpty), func(t *testing.T) {
+			opts := &Options{
+				StopOnEmpty: test.stopOnEmpty,
+				Timeout:     5 * time.Second,
+			}
+			entries, err := unpage(ctx, server.URL+"/?page=1", opts)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(entries, test.expected) {
+				t.Errorf("got %v; want %v", entries, test.expected)
+			}
+		})
+	}
+}
+
+func TestUnpage_LateLastLink(t *testing.T) {
+	// Next links to page 5 with the last one only from page lastFrom
+	const lastPage = 5
+	tests := []struct {
+		name     string
+		lastFrom int
+	}{
+		{"no last", 0},
+		{"last on page 2", 2},
+		{"last on page 4", 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var requested []string
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				requested = append(requested, r.URL.RawQuery)
+				mu.Unlock()
+				page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+				var links []string
+				if page < lastPage {
+					// Next links that don't look like the URL with the page parameter
+					links = append(links, fmt.Sprintf(`</?page=%d&next=1>; rel="next"`, page+1))
+				}
+				if test.lastFrom > 0 && page >= test.lastFrom {
+					links = append(links, fmt.Sprintf(`</?page=%d>; rel="last"`, lastPage))
+				}
+				w.Header().Set("Link", strings.Join(links, ", "))
+				json.NewEncoder(w).Encode([]any{page})
+			})
+
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			opts := &Options{
+				ParamPage: "page",
+				Timeout:   5 * time.Second,
+			}
+			entries, err := unpage(ctx, server.URL, opts)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if expected := numbers(1, 2, 3, 4, 5); !reflect.DeepEqual(entries, expected) {
+				t.Errorf("Expected %v, got %v", expected, entries)
+			}
+
+			// The pages after the one with the last link are fetched by number
+			var followed int
+			for _, query := range requested {
+				if strings.Contains(query, "next=1") {
+					followed++
+				}
+			}
+			expected := lastPage - 1
+			if test.lastFrom > 0 {
+				expected = test.lastFrom - 1
+			}
+			if followed != expected || len(requested) != lastPage {
+				t.Errorf("Expected %d of %d pages from next links, got %v", expected, lastPage, requested)
+			}
+		})
+	}
+}
+
+func TestUnpage_RetryEmpty(t *testing.T) {
+	// The second page is empty the first two times
+	var second atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data := map[string]any{"data": []any{1}, "next": "/2"}
+		if r.URL.Path == "/2" {
+			data = map[string]any{"data": []any{}}
+			if second.Add(1) > 2 {
+				data["data"] = []any{2}
+			}
+		}
+		json.NewEncoder(w).Encode(data)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		retryEmpty int
+		expected   []any
+		requests   int32
+	}{
+		{0, numbers(1), 1},
+		{1, numbers(1), 2},
+		{5, numbers(1, 2), 3},
+	}
+
+	for _, test := range tests {
+		t.Run(strconv.Itoa(test.retryEmpty), func(t *testing.T) {
+			second.Store(0)
+			opts := &Options{
+				DataKey:      "data",
+				NextKey:      "next",
+				RetryEmpty:   test.retryEmpty,
+				RetryMaxWait: time.Millisecond,
+				Timeout:      5 * time.Second,
+			}
+			entries, err := unpage(ctx, server.URL, opts)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(entries, test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, entries)
+			}
+			if second.Load() != test.requests {
+				t.Errorf("Expected %d requests for the second page, got %d", test.requests, second.Load())
+			}
+		})
+	}
+}
+
+func TestUnpage_BareArrayPages(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("page") {
+		case "2":
+			w.Header().Set("Link", `</?page=3>; rel="next"`)
+			json.NewEncoder(w).Encode([]any{2})
+		case "3":
+			json.NewEncoder(w).Encode([]any{3})
+		default:
+			data := map[string]any{
+				"result": map[string]any{"data": []any{1}, "next": "/?page=2"},
+			}
+			json.NewEncoder(w).Encode(data)
+		}
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		DataKey: "result.data",
+		NextKey: "result.next",
+		Timeout: 5 * time.Second,
+	}
+
+	entries, err := unpage(ctx, server.URL, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(entries, numbers(1, 2, 3)) {
+		t.Errorf("Unexpected entries: %v", entries)
+	}
+}
+
+func TestUnpage_AnnotatePage(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		w.Header().Set("Link", `</?page=3>; rel="last"`)
+		data := map[string]any{
+			"data": []any{map[string]any{"id": page}, "string"},
+		}
+		json.NewEncoder(w).Encode(data)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var buf strings.Builder
+	opts := &Options{
+		ParamPage:    "page",
+		DataKey:      "data",
+		AnnotatePage: "_page",
+		Timeout:      5 * time.Second,
+		Logger:       log.New(&buf, "", 0),
+	}
+
+	entries, err := unpage(ctx, server.URL, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for i, page := range []int{1, 2, 3} {
+		entry := entries[2*i].(map[string]any)
+		if entry["_page"] != page {
+			t.Errorf("Expected entry %v to be from page %d", entry, page)
+		}
+		if entries[2*i+1] != "string" {
+			t.Errorf("Expected the string to be kept, got %v", entries[2*i+1])
+		}
+	}
+	if strings.Count(buf.String(), "WARNING") != 1 {
+		t.Errorf("Expected a single warning, got %q", buf.String())
+	}
+}
+
+func TestUnpage_HALLinks(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		links := map[string]any{}
+		if page < 3 {
+			links["next"] = map[string]any{"href": fmt.Sprintf("/?page=%d", page+1)}
+		}
+		data := map[string]any{
+			"_embedded": map[string]any{"items": []any{page}},
+			"_links":    links,
+		}
+		json.NewEncoder(w).Encode(data)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		DataKey: "_embedded.items",
+		NextKey: "_links.next",
+		Timeout: 5 * time.Second,
+	}
+
+	entries, err := unpage(ctx, server.URL+"/?page=1", opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(entries, numbers(1, 2, 3)) {
+		t.Errorf("Unexpected entries: %v", entries)
+	}
+}
+
+func TestGetEntries(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         any
+		dataKey      string
+		singleObject bool
+		expected     []any
+		wantErr      bool
+	}{
+		{"array", map[string]any{"data": []any{1.0}}, "data", false, []any{1.0}, false},
+		{"empty array", map[string]any{"data": []any{}}, "data", false, []any{}, false},
+		{"null", map[string]any{"data": nil}, "data", false, []any{}, false},
+		{"missing", map[string]any{"other": 1.0}, "data", false, []any{}, false},
+		{"bare array", []any{1.0, 2.0}, "data", false, []any{1.0, 2.0}, false},
+		{"string", map[string]any{"data": "none"}, "data", false, nil, true},
+		{"number", map[string]any{"data": 0.0}, "data", false, nil, true},
+		{"object", map[string]any{"data": map[string]any{}}, "data", false, nil, true},
+		{"scalar body", "data", "data", false, nil, true},
+		{"single object", map[string]any{"data": map[string]any{"id": 1.0}}, "data", true, []any{map[string]any{"id": 1.0}}, false},
+		{"single null", map[string]any{"data": nil}, "data", true, []any{}, false},
+		{"single array", map[string]any{"data": []any{1.0}}, "data", true, []any{1.0}, false},
+		{"single body", map[string]any{"id": 1.0}, "", true, []any{map[string]any{"id": 1.0}}, false},
+		{"body without key", map[string]any{"id": 1.0}, "", false, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := getEntries(test.body, test.dataKey, test.singleObject)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("getEntries(%v) error = %v; wantErr %v", test.body, err, test.wantErr)
+			}
+			if !reflect.DeepEqual(entries, test.expected) {
+				t.Errorf("getEntries(%v) = %v; want %v", test.body, entries, test.expected)
+			}
+		})
+	}
+}
+
+func TestUnpage_SingleObject(t *testing.T) {
+	// One record per page with a null one at the end
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		w.Header().Set("Link", `</?page=3>; rel="last"`)
+		var item any
+		if page < 3 {
+			item = map[string]any{"id": page}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"item": item})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		ParamPage:    "page",
+		DataKey:      "item",
+		SingleObject: true,
+		Timeout:      5 * time.Second,
+	}
+
+	entries, err := unpage(ctx, server.URL, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []any{
+		map[string]any{"id": json.Number("1")},
+		map[string]any{"id": json.Number("2")},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected %v, got %v", expected, entries)
+	}
+}
+
+func TestUnpage_NullDataEndsNextLinks(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data := map[string]any{
+			"data":  []any{1, 2},
+			"links": map[string]any{"next": "/?page=2"},
+		}
+		if r.URL.Query().Get("page") == "2" {
+			data = map[string]any{
+				"data":  nil,
+				"links": map[string]any{"next": nil},
+			}
+		}
+		json.NewEncoder(w).Encode(data)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		DataKey: "data",
+		NextKey: "links.next",
+		Timeout: 5 * time.Second,
+	}
+
+	entries, err := unpage(ctx, server.URL, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Expected 2 entries, got %d", len(entries))
+	}
+}
+
+func TestExtractEntries_EntryKey(t *testing.T) {
+	body := map[string]any{
+		"result": map[string]any{
+			"edges": []any{
+				map[string]any{"node": map[string]any{"id": 1.0, "name": "a"}, "cursor": "x"},
+				map[string]any{"node": map[string]any{"id": 2.0, "name": "b"}, "cursor": "y"},
+				map[string]any{"cursor": "z"},
+			},
+		},
+	}
+	opts := &Options{
+		DataKey:  "result.edges",
+		EntryKey: "node",
+		Pick:     []string{"id"},
+	}
+
+	entries, err := extractEntries(body, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []any{map[string]any{"id": 1.0}, map[string]any{"id": 2.0}, nil}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("extractEntries = %v; want %v", entries, expected)
+	}
+}
+
+func TestPickFields(t *testing.T) {
+	entry := map[string]any{
+		"id":   1,
+		"name": "Item 1",
+		"user": map[string]any{
+			"login": "foo",
+			"email": "foo@example.com",
+		},
+	}
+
+	tests := []struct {
+		fields   []string
+		expected map[string]any
+	}{
+		{[]string{"id"}, map[string]any{"id": 1}},
+		{[]string{"id", "user.login"}, map[string]any{"id": 1, "user": map[string]any{"login": "foo"}}},
+		{[]string{"user"}, map[string]any{"user": entry["user"]}},
+		{[]string{"missing", "user.missing"}, map[string]any{}},
+	}
+
+	for _, test := range tests {
+		t.Run(strings.Join(test.fields, ","), func(t *testing.T) {
+			result := pickFields(entry, test.fields)
+			if !reflect.DeepEqual(result, test.expected) {
+				t.Errorf("pickFields(%v) = %v; want %v", test.fields, result, test.expected)
+			}
+		})
+	}
+}
+
+func TestGetNextLastLinks(t *testing.T) {
+	tests := []struct {
+		header       string
+		expectedNext string
+		expectedLast string
+	}{
+		{
+			header:       `<https://example.com/page/2>; rel="next", <https://example.com/page/10>; rel="last"`,
+			expectedNext: "https://example.com/page/2",
+			expectedLast: "https://example.com/page/10",
+		},
+		{
+			header:       `<https://example.com/page/5>; rel="next"`,
+			expectedNext: "https://example.com/page/5",
+			expectedLast: "",
+		},
+		{
+			header:       `<https://example.com/page/5>; rel="last"`,
+			expectedNext: "",
+			expectedLast: "https://example.com/page/5",
+		},
+		{
+			header:       "",
+			expectedNext: "",
+			expectedLast: "",
+		},
+		{
+			header:       `<https://example.com/page/2>; rel="next", <https://example.com/page/5>; rel="prev"`,
+			expectedNext: "https://example.com/page/2",
+			expectedLast: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			next, last := getNextLastLinks(tt.header)
+			if next != tt.expectedNext {
+				t.Errorf("expected next %q, got %q", tt.expectedNext, next)
+			}
+			if last != tt.expectedLast {
+				t.Errorf("expected last %q, got %q", tt.expectedLast, last)
+			}
+		})
+	}
+}
+
+func TestResolveLink(t *testing.T) {
+	base, _ := url.Parse("https://example.com/api/v1/items?page=1")
+
+	tests := []struct {
+		link     string
+		expected string
+	}{
+		{"https://example.org/items?page=2", "https://example.org/items?page=2"},
+		{"/api/v1/items?page=2", "https://example.com/api/v1/items?page=2"},
+		{"./items?page=2", "https://example.com/api/v1/items?page=2"},
+		{"?page=2", "https://example.com/api/v1/items?page=2"},
+		{"page2?cursor=x", "https://example.com/api/v1/page2?cursor=x"},
+		{"../v2/items?page=2", "https://example.com/api/v2/items?page=2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.link, func(t *testing.T) {
+			result, err := resolveLink(base, test.link)
+			if err != nil {
+				t.Fatalf("resolveLink(%q) returned an error: %v", test.link, err)
+			}
+			if result != test.expected {
+				t.Errorf("resolveLink(%q) = %q; want %q", test.link, result, test.expected)
+			}
+		})
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"https://example.com/api?page=1", false},
+		{"http://localhost:8080", false},
+		{"ftp://example.com/file", true},
+		{"example.com/api", true},
+		{"https:///path", true},
+		{"https://example.com/%zz", true},
+		{"", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			err := validateURL(test.url)
+			if (err != nil) != test.wantErr {
+				t.Errorf("validateURL(%q) = %v; wantErr %v", test.url, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	headers := map[string]string{
+		"Accept":     "application/json",
+		"User-Agent": "agent/1.0",
+	}
+	lines := []string{"user-agent: file/1.0", "X-Token: a:b", "User-Agent: header/1.0"}
+	if err := parseHeaders(headers, lines, false); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := map[string]string{
+		"Accept":     "application/json",
+		"User-Agent": "header/1.0",
+		"X-Token":    "a:b",
+	}
+	if !reflect.DeepEqual(headers, expected) {
+		t.Errorf("got %v; want %v", headers, expected)
+	}
+
+	if err := parseHeaders(headers, []string{"Invalid"}, false); err == nil {
+		t.Errorf("Expected error for invalid header")
+	}
+}
+
+func TestReadHeaderFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "headers")
+	data := "# API headers\nAccept: application/vnd.api+json\r\n\n  X-Api-Key: abc:def  \n"
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	headers, err := readHeaderFile(file)
+	if err != nil {
+		t.Fatalf("readHeaderFile returned an error: %v", err)
+	}
+	expected := []string{"Accept: application/vnd.api+json", "X-Api-Key: abc:def"}
+	if !reflect.DeepEqual(headers, expected) {
+		t.Errorf("readHeaderFile = %q; want %q", headers, expected)
+	}
+
+	if _, err := readHeaderFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("Expected error for missing file")
+	}
+}
+
+func TestExpandQuery(t *testing.T) {
+	t.Setenv("UNPAGE_TOKEN", "s3cr=t")
+
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"https://example.com/api", "https://example.com/api"},
+		{"https://example.com/api?token=$UNPAGE_TOKEN&page=1", "https://example.com/api?token=s3cr%3Dt&page=1"},
+		{"https://example.com/api?token=${UNPAGE_TOKEN}", "https://example.com/api?token=s3cr%3Dt"},
+		{"https://example.com/api?token=$UNPAGE_UNSET", "https://example.com/api?token="},
+		{"https://example.com/api?token=%24UNPAGE_TOKEN#top", "https://example.com/api?token=s3cr%3Dt#top"},
+		// The page placeholder of --page-url-template is kept
+		{"https://example.com/items/page/{page}?token=$UNPAGE_TOKEN", "https://example.com/items/page/{page}?token=s3cr%3Dt"},
+		{"https://example.com/items?offset={page}&token=$UNPAGE_TOKEN", "https://example.com/items?offset={page}&token=s3cr%3Dt"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			result, err := expandQuery(test.url)
+			if err != nil {
+				t.Fatalf("expandQuery(%q) returned an error: %v", test.url, err)
+			}
+			if result != test.expected {
+				t.Errorf("expandQuery(%q) = %q; want %q", test.url, result, test.expected)
+			}
+		})
+	}
+}
+
+func TestGetPage(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"key": "value"}`)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx := context.Background()
+	urlStr := server.URL
+	params := map[string]string{}
+
+	client := &http.Client{
+		Timeout: time.Duration(1) * time.Second,
+	}
+
+	resp, err := getPage(ctx, client, urlStr, params, &Options{})
+	if err != nil {
+		t.Fatalf("getPage returned an error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		t.Fatalf("Failed to decode response: %v", err)
 	}
 
@@ -372,3 +2630,222 @@ func TestGetPage(t *testing.T) {
 		t.Errorf("Unexpected response body: got %v, want %v", result, map[string]any{"key": "value"})
 	}
 }
+
+// benchmarkUnpage measures fetching 50 pages and writing them out
+func benchmarkUnpage(b *testing.B, emit func(page int, entries []any) error) {
+	const lastPage, pageSize = 50, 100
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		w.Header().Set("Link", fmt.Sprintf("</?page=%d>; rel=\"last\"", lastPage))
+		entries := make([]any, pageSize)
+		for i := range entries {
+			entries[i] = map[string]any{"id": (page-1)*pageSize + i, "name": "Item"}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": entries})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	opts := &Options{
+		ParamPage: "page",
+		DataKey:   "data",
+		Timeout:   5 * time.Second,
+		Emit:      emit,
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		entries, err := unpage(context.Background(), server.URL, opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if emit == nil {
+			if err := json.NewEncoder(io.Discard).Encode(entries); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkUnpage_Collect(b *testing.B) {
+	benchmarkUnpage(b, nil)
+}
+
+func BenchmarkUnpage_Stream(b *testing.B) {
+	w := newArrayWriter(io.Discard)
+	benchmarkUnpage(b, w.write)
+}
+
+// benchmarkBufferPages measures the peak heap while fetching 200 pages
+// with a slow second page that makes the rest pile up unless capped
+func benchmarkBufferPages(b *testing.B, bufferPages int) {
+	const lastPage, pageSize = 200, 100
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 2 {
+			time.Sleep(20 * time.Millisecond)
+		}
+		w.Header().Set("Link", fmt.Sprintf("</?page=%d>; rel=\"last\"", lastPage))
+		entries := make([]any, pageSize)
+		for i := range entries {
+			entries[i] = map[string]any{"id": (page-1)*pageSize + i, "name": "Item"}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": entries})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	var peak uint64
+	var stats runtime.MemStats
+	w := newArrayWriter(io.Discard)
+	opts := &Options{
+		ParamPage:   "page",
+		DataKey:     "data",
+		BufferPages: bufferPages,
+		Timeout:     5 * time.Second,
+		Emit: func(page int, entries []any) error {
+			runtime.ReadMemStats(&stats)
+			peak = max(peak, stats.HeapAlloc)
+			return w.write(page, entries)
+		},
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if _, err := unpage(context.Background(), server.URL, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(peak)/(1<<20), "peak-MB")
+}
+
+func BenchmarkUnpage_Unbuffered(b *testing.B) {
+	benchmarkBufferPages(b, 0)
+}
+
+func BenchmarkUnpage_BufferPages(b *testing.B) {
+	benchmarkBufferPages(b, 10)
+}
+
+func TestNewTransport(t *testing.T) {
+	tests := []struct {
+		maxConnsPerHost int
+		maxIdlePerHost  int
+	}{
+		{0, concurrency},
+		{10, 10},
+		{100, concurrency},
+	}
+
+	for _, test := range tests {
+		t.Run(strconv.Itoa(test.maxConnsPerHost), func(t *testing.T) {
+			transport := newTransport(&Options{MaxConnsPerHost: test.maxConnsPerHost})
+			if transport.MaxConnsPerHost != test.maxConnsPerHost {
+				t.Errorf("MaxConnsPerHost = %d; want %d", transport.MaxConnsPerHost, test.maxConnsPerHost)
+			}
+			if transport.MaxIdleConnsPerHost != test.maxIdlePerHost {
+				t.Errorf("MaxIdleConnsPerHost = %d; want %d", transport.MaxIdleConnsPerHost, test.maxIdlePerHost)
+			}
+			if transport.MaxIdleConns < transport.MaxIdleConnsPerHost {
+				t.Errorf("MaxIdleConns = %d is less than MaxIdleConnsPerHost", transport.MaxIdleConns)
+			}
+		})
+	}
+}
+
+// benchmarkDials measures fetching 200 pages with a client shared across
+// iterations, reporting the connections opened per iteration
+func benchmarkDials(b *testing.B, transport http.RoundTripper) {
+	const lastPage = 200
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", fmt.Sprintf("</?page=%d>; rel=\"last\"", lastPage))
+		json.NewEncoder(w).Encode(map[string]any{"data": []any{1}})
+	})
+
+	var dials atomic.Int64
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	opts := &Options{
+		ParamPage: "page",
+		DataKey:   "data",
+		Timeout:   5 * time.Second,
+		Client:    &http.Client{Transport: transport, Timeout: 5 * time.Second},
+		Limiter:   semaphore.NewWeighted(concurrency),
+	}
+
+	b.ResetTimer()
+	for range b.N {
+		if _, err := unpage(context.Background(), server.URL, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(dials.Load())/float64(b.N), "dials/op")
+}
+
+func BenchmarkUnpage_DefaultTransport(b *testing.B) {
+	benchmarkDials(b, http.DefaultTransport.(*http.Transport).Clone())
+}
+
+func BenchmarkUnpage_PooledTransport(b *testing.B) {
+	benchmarkDials(b, newTransport(&Options{}))
+}
+
+func TestGetPage_Verbose(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Test", "yes")
+		fmt.Fprintln(w, `{"key": "value"}`)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	tests := []struct {
+		verbose  int
+		contains []string
+		excludes []string
+	}{
+		{0, nil, []string{"GET"}},
+		{1, []string{"GET " + server.URL + ": 200 OK"}, []string{"X-Test"}},
+		{2, []string{"GET ", "> User-Agent: test", "< X-Test: yes"}, []string{`"key"`}},
+		{3, []string{"GET ", "X-Test: yes", `{"key": "value"}`}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(strconv.Itoa(test.verbose), func(t *testing.T) {
+			var buf strings.Builder
+			opts := &Options{
+				Headers: map[string]string{"User-Agent": "test"},
+				Verbose: test.verbose,
+				Logger:  log.New(&buf, "", 0),
+			}
+			client := &http.Client{Timeout: time.Second}
+			resp, err := getPage(context.Background(), client, server.URL, nil, opts)
+			if err != nil {
+				t.Fatalf("getPage returned an error: %v", err)
+			}
+			resp.Body.Close()
+
+			for _, s := range test.contains {
+				if !strings.Contains(buf.String(), s) {
+					t.Errorf("Expected %q in log, got %q", s, buf.String())
+				}
+			}
+			for _, s := range test.excludes {
+				if strings.Contains(buf.String(), s) {
+					t.Errorf("Unexpected %q in log, got %q", s, buf.String())
+				}
+			}
+		})
+	}
+}
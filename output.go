@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// arrayWriter writes the entries of each page as elements of a JSON array
+type arrayWriter struct {
+	w     *bufio.Writer
+	buf   bytes.Buffer
+	enc   *json.Encoder
+	count int
+	// flushPages flushes the output every this many pages instead of each
+	flushPages int
+	pages      int
+}
+
+func newArrayWriter(w io.Writer) *arrayWriter {
+	a := &arrayWriter{w: bufio.NewWriter(w)}
+	a.enc = json.NewEncoder(&a.buf)
+	return a
+}
+
+func (a *arrayWriter) write(_ int, entries []any) error {
+	for _, entry := range entries {
+		a.buf.Reset()
+		if err := a.enc.Encode(entry); err != nil {
+			return err
+		}
+		if a.count == 0 {
+			a.w.WriteByte('[')
+		} else {
+			a.w.WriteByte(',')
+		}
+		// Skip the newline added by Encode
+		a.w.Write(a.buf.Bytes()[:a.buf.Len()-1])
+		a.count++
+	}
+	a.pages++
+	if a.flushPages > 0 && a.pages%a.flushPages != 0 {
+		return nil
+	}
+	return a.w.Flush()
+}
+
+// close terminates the array
+func (a *arrayWriter) close() error {
+	if a.count == 0 {
+		a.w.WriteByte('[')
+	}
+	a.w.WriteString("]\n")
+	return a.w.Flush()
+}
+
+// collector gathers the entries of all pages
+type collector struct {
+	entries []any
+	pages   int
+	// byPage, if set, keeps the entries of each page
+	byPage pageGroups
+}
+
+func newCollector() *collector {
+	return &collector{entries: make([]any, 0)}
+}
+
+func (c *collector) write(page int, entries []any) error {
+	c.entries = append(c.entries, entries...)
+	c.pages = page
+	if c.byPage != nil {
+		c.byPage[page] = entries
+	}
+	return nil
+}
+
+// pageGroups maps each page number to its entries, which are
+// empty for empty pages and null for those that failed
+type pageGroups map[int][]any
+
+// MarshalJSON writes an object keyed by the page numbers in order
+func (g pageGroups) MarshalJSON() ([]byte, error) {
+	pages := make([]int, 0, len(g))
+	for page := range g {
+		pages = append(pages, page)
+	}
+	sort.Ints(pages)
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, page := range pages {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		entries, err := json.Marshal(g[page])
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, `"%d":%s`, page, entries)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// summary counts the entries and pages written
+type summary struct {
+	mu      sync.Mutex
+	entries int
+	pages   int
+	start   time.Time
+}
+
+func newSummary() *summary {
+	return &summary{start: time.Now()}
+}
+
+// count wraps emit to count what it's passed
+func (s *summary) count(emit func(page int, entries []any) error) func(page int, entries []any) error {
+	return func(page int, entries []any) error {
+		s.mu.Lock()
+		s.entries += len(entries)
+		s.pages++
+		s.mu.Unlock()
+		return emit(page, entries)
+	}
+}
+
+func (s *summary) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("fetched %d items across %d pages in %v", s.entries, s.pages, time.Since(s.start).Round(time.Millisecond))
+}
+
+// metaOutput wraps the entries with where they came from
+type metaOutput struct {
+	Count int    `json:"count"`
+	Pages int    `json:"pages"`
+	URL   string `json:"url"`
+	Items []any  `json:"items"`
+}
+
+// csvValue formats a JSON value as a CSV field
+func csvValue(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case json.Number:
+		return v.String(), nil
+	default:
+		// Nested objects & arrays are written as JSON
+		data, err := json.Marshal(v)
+		return string(data), err
+	}
+}
+
+// writeCSV writes the entries, which must be objects, as CSV with a header
+// row of the fields, or the union of all keys sorted if none are given
+func writeCSV(w io.Writer, entries []any, fields []string) error {
+	records := make([]map[string]any, len(entries))
+	for i, entry := range entries {
+		m, ok := entry.(map[string]any)
+		if !ok {
+			return fmt.Errorf("entry %d is not an object: %T", i, entry)
+		}
+		records[i] = m
+	}
+
+	if len(fields) == 0 {
+		keys := make(map[string]bool)
+		for _, record := range records {
+			for key := range record {
+				if !keys[key] {
+					keys[key] = true
+					fields = append(fields, key)
+				}
+			}
+		}
+		sort.Strings(fields)
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(fields); err != nil {
+		return err
+	}
+	row := make([]string, len(fields))
+	for _, record := range records {
+		for i, field := range fields {
+			value, err := csvValue(getNestedValue(record, field))
+			if err != nil {
+				return err
+			}
+			row[i] = value
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// errorOutput is written to stderr for each error with --json-errors
+type errorOutput struct {
+	Error  string `json:"error,omitempty"`
+	URL    string `json:"url"`
+	Status int    `json:"status,omitempty"`
+	Page   int    `json:"page,omitempty"`
+}
+
+// newErrorOutput describes err with the HTTP status
+// and the page number when they're known
+func newErrorOutput(urlStr string, err error) errorOutput {
+	output := errorOutput{Error: err.Error(), URL: urlStr}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		output.Status = statusErr.StatusCode
+	}
+	var pageErr *PageError
+	if errors.As(err, &pageErr) {
+		output.Page = pageErr.Page
+	}
+	return output
+}
+
+// writeJSONError writes err as a JSON object
+func writeJSONError(w io.Writer, urlStr string, err error) error {
+	output := newErrorOutput(urlStr, err)
+	return json.NewEncoder(w).Encode(&output)
+}
+
+// appendArray replaces the JSON array in file, if any,
+// with one that has the entries appended
+func appendArray(file string, entries []any, marshal func(any) ([]byte, error)) error {
+	var existing []any
+	data, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&existing); err != nil {
+			return fmt.Errorf("%s: not a JSON array: %w", file, err)
+		}
+	}
+	// Write [] rather than null when there are no entries yet
+	all := make([]any, 0, len(existing)+len(entries))
+	output, err := marshal(append(append(all, existing...), entries...))
+	if err != nil {
+		return err
+	}
+	perm := os.FileMode(0o644)
+	if info, err := os.Stat(file); err == nil {
+		perm = info.Mode().Perm()
+	}
+	return writeFileAtomic(file, append(output, '\n'), perm)
+}
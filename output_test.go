@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArrayWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		pages    [][]any
+		expected string
+	}{
+		{"empty", nil, "[]\n"},
+		{"empty pages", [][]any{{}, {}}, "[]\n"},
+		{"single", [][]any{{1}}, "[1]\n"},
+		{"multiple", [][]any{{1, 2}, {}, {map[string]any{"a": "b"}}}, `[1,2,{"a":"b"}]` + "\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := newArrayWriter(&buf)
+			for i, entries := range test.pages {
+				if err := w.write(i+1, entries); err != nil {
+					t.Fatalf("write returned an error: %v", err)
+				}
+			}
+			if err := w.close(); err != nil {
+				t.Fatalf("close returned an error: %v", err)
+			}
+			if buf.String() != test.expected {
+				t.Errorf("got %q; want %q", buf.String(), test.expected)
+			}
+		})
+	}
+}
+
+func TestArrayWriter_FlushPages(t *testing.T) {
+	var buf bytes.Buffer
+	w := newArrayWriter(&buf)
+	w.flushPages = 2
+	expected := []string{"", "[1,2", "[1,2", "[1,2,3,4", "[1,2,3,4"}
+	for i := range 5 {
+		if err := w.write(i+1, []any{i + 1}); err != nil {
+			t.Fatalf("write returned an error: %v", err)
+		}
+		if buf.String() != expected[i] {
+			t.Errorf("after page %d got %q; want %q", i+1, buf.String(), expected[i])
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatalf("close returned an error: %v", err)
+	}
+	if buf.String() != "[1,2,3,4,5]\n" {
+		t.Errorf("got %q; want %q", buf.String(), "[1,2,3,4,5]\n")
+	}
+}
+
+func TestCollector(t *testing.T) {
+	c := newCollector()
+	for i, entries := range [][]any{{1, 2}, {}, {3}} {
+		if err := c.write(i+1, entries); err != nil {
+			t.Fatalf("write returned an error: %v", err)
+		}
+	}
+
+	output, err := json.Marshal(&metaOutput{
+		Count: len(c.entries),
+		Pages: c.pages,
+		URL:   "https://example.com",
+		Items: c.entries,
+	})
+	if err != nil {
+		t.Fatalf("Marshal returned an error: %v", err)
+	}
+	expected := `{"count":3,"pages":3,"url":"https://example.com","items":[1,2,3]}`
+	if string(output) != expected {
+		t.Errorf("got %s; want %s", output, expected)
+	}
+}
+
+func TestCollector_ByPage(t *testing.T) {
+	c := newCollector()
+	c.byPage = make(pageGroups)
+	for _, page := range []int{2, 10, 1, 3} {
+		var entries []any
+		switch page {
+		case 1, 10:
+			entries = []any{page}
+		case 2:
+			entries = []any{}
+		}
+		if err := c.write(page, entries); err != nil {
+			t.Fatalf("write returned an error: %v", err)
+		}
+	}
+
+	output, err := json.Marshal(c.byPage)
+	if err != nil {
+		t.Fatalf("Marshal returned an error: %v", err)
+	}
+	expected := `{"1":[1],"2":[],"3":null,"10":[10]}`
+	if string(output) != expected {
+		t.Errorf("got %s; want %s", output, expected)
+	}
+
+	output, err = json.MarshalIndent(c.byPage, "", "  ")
+	if err != nil {
+		t.Fatalf("MarshalIndent returned an error: %v", err)
+	}
+	if !strings.HasPrefix(string(output), "{\n  \"1\": [\n    1\n  ],") {
+		t.Errorf("got %s", output)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	s := newSummary()
+	c := newCollector()
+	emit := s.count(c.write)
+	for i, entries := range [][]any{{1, 2}, {}, {3}} {
+		if err := emit(i+1, entries); err != nil {
+			t.Fatalf("emit returned an error: %v", err)
+		}
+	}
+	if len(c.entries) != 3 {
+		t.Errorf("got %d entries passed through; want 3", len(c.entries))
+	}
+	if got := s.String(); !strings.HasPrefix(got, "fetched 3 items across 3 pages in ") {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	entries := []any{
+		map[string]any{"id": 1.0, "name": "Item, 1", "user": map[string]any{"login": "foo"}},
+		map[string]any{"id": json.Number("12345678901234567890"), "done": true, "name": nil},
+	}
+
+	tests := []struct {
+		name     string
+		fields   []string
+		expected string
+	}{
+		{
+			name:     "union of keys",
+			expected: "done,id,name,user\n,1,\"Item, 1\",\"{\"\"login\"\":\"\"foo\"\"}\"\ntrue,12345678901234567890,,\n",
+		},
+		{
+			name:     "fields",
+			fields:   []string{"user.login", "id"},
+			expected: "user.login,id\nfoo,1\n,12345678901234567890\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeCSV(&buf, entries, test.fields); err != nil {
+				t.Fatalf("writeCSV returned an error: %v", err)
+			}
+			if buf.String() != test.expected {
+				t.Errorf("got %q; want %q", buf.String(), test.expected)
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := writeCSV(&buf, []any{map[string]any{}, "string"}, nil); err == nil {
+		t.Errorf("Expected error for non-object entries")
+	}
+}
+
+func TestWriteJSONError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{
+			name:     "plain error",
+			err:      errors.New("boom"),
+			expected: `{"error":"boom","url":"http://example.com"}` + "\n",
+		},
+		{
+			name:     "status on page",
+			err:      &PageError{Page: 7, Err: &StatusError{StatusCode: 502, Body: "bad"}},
+			expected: `{"error":"page 7: HTTP request failed with status 502: Bad Gateway: bad","url":"http://example.com","status":502,"page":7}` + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeJSONError(&buf, "http://example.com", test.err); err != nil {
+				t.Fatalf("writeJSONError returned an error: %v", err)
+			}
+			if buf.String() != test.expected {
+				t.Errorf("got %q; want %q", buf.String(), test.expected)
+			}
+		})
+	}
+}
+
+func TestAppendArray(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "out.json")
+
+	for _, entries := range [][]any{{json.Number("1"), "a"}, {}, {json.Number("12345678901234567890")}} {
+		if err := appendArray(file, entries, json.Marshal); err != nil {
+			t.Fatalf("appendArray returned an error: %v", err)
+		}
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "[1,\"a\",12345678901234567890]\n"; string(data) != expected {
+		t.Errorf("got %q; want %q", data, expected)
+	}
+
+	// The first run may have no entries
+	empty := filepath.Join(t.TempDir(), "empty.json")
+	if err := appendArray(empty, []any{}, json.Marshal); err != nil {
+		t.Fatalf("appendArray returned an error: %v", err)
+	}
+	if data, err := os.ReadFile(empty); err != nil || string(data) != "[]\n" {
+		t.Errorf("got %q, %v; want \"[]\\n\"", data, err)
+	}
+
+	if err := os.WriteFile(file, []byte(`{"not":"array"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendArray(file, []any{1}, json.Marshal); err == nil {
+		t.Errorf("Expected error appending to an object")
+	}
+}
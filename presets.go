@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	flag "github.com/spf13/pflag"
+)
+
+// preset has the flags and headers for a common API style
+type preset struct {
+	flags   map[string]string
+	headers map[string]string
+	// tokenEnv is the environment variable with a bearer token, if any
+	tokenEnv string
+}
+
+var presets = map[string]preset{
+	"jsonapi": {
+		flags: map[string]string{
+			"data-key":  "data",
+			"next-key":  "links.next",
+			"last-key":  "links.last",
+			"count-key": "meta.total",
+		},
+	},
+	// GitHub returns bare arrays with Link headers that have the last page
+	"github": {
+		flags: map[string]string{
+			"param-page": "page",
+		},
+		headers: map[string]string{
+			"Accept": "application/vnd.github+json",
+		},
+		tokenEnv: "GITHUB_TOKEN",
+	},
+}
+
+// profile is a preset defined by the user in the profiles file
+type profile struct {
+	Flags map[string]string `json:"flags"`
+	// Headers are "Name: value" lines as in --header-file
+	Headers []string `json:"headers"`
+}
+
+// setFlags sets the flags that weren't given to the values
+func setFlags(flags *flag.FlagSet, values map[string]string) error {
+	for key, value := range values {
+		if flags.Changed(key) {
+			continue
+		}
+		if err := flags.Set(key, value); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// applyPreset sets the flags in the preset that weren't given
+// and returns the headers to set before those given
+func applyPreset(flags *flag.FlagSet, name string) (map[string]string, error) {
+	preset, ok := presets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown preset %q", name)
+	}
+	if err := setFlags(flags, preset.flags); err != nil {
+		return nil, err
+	}
+	headers := make(map[string]string, len(preset.headers)+1)
+	for key, value := range preset.headers {
+		headers[key] = value
+	}
+	if token := os.Getenv(preset.tokenEnv); preset.tokenEnv != "" && token != "" {
+		headers["Authorization"] = "Bearer " + token
+	}
+	return headers, nil
+}
+
+// defaultProfilesFile is where the profiles are read from by default
+func defaultProfilesFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "unpage", "profiles.json")
+}
+
+// applyProfile sets the flags in the profile from the JSON file that weren't
+// given and returns its header lines to set before those given
+func applyProfile(flags *flag.FlagSet, file, name string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var profiles map[string]profile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q in %s", name, file)
+	}
+	if err := setFlags(flags, profile.Flags); err != nil {
+		return nil, fmt.Errorf("profile %s: %w", name, err)
+	}
+	return profile.Headers, nil
+}
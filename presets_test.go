@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	flag "github.com/spf13/pflag"
+)
+
+func TestApplyPreset(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	dataKey := flags.String("data-key", "", "")
+	nextKey := flags.String("next-key", "", "")
+	flags.String("last-key", "", "")
+	flags.String("count-key", "", "")
+	paramPage := flags.String("param-page", "", "")
+	if err := flags.Parse([]string{"--next-key", "next"}); err != nil {
+		t.Fatal(err)
+	}
+
+	headers, err := applyPreset(flags, "jsonapi")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if *dataKey != "data" {
+		t.Errorf("Expected data-key from the preset, got %q", *dataKey)
+	}
+	if *nextKey != "next" {
+		t.Errorf("Expected next-key given to be kept, got %q", *nextKey)
+	}
+	if len(headers) != 0 {
+		t.Errorf("Expected no headers, got %v", headers)
+	}
+
+	t.Setenv("GITHUB_TOKEN", "secret")
+	headers, err = applyPreset(flags, "github")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if *paramPage != "page" {
+		t.Errorf("Expected param-page from the preset, got %q", *paramPage)
+	}
+	expected := map[string]string{
+		"Accept":        "application/vnd.github+json",
+		"Authorization": "Bearer secret",
+	}
+	if !reflect.DeepEqual(headers, expected) {
+		t.Errorf("got %v; want %v", headers, expected)
+	}
+
+	if _, err := applyPreset(flags, "unknown"); err == nil {
+		t.Errorf("Expected error for unknown preset")
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "profiles.json")
+	profiles := `{
+		"gitlab": {
+			"flags": {"param-page": "page", "data-key": "items"},
+			"headers": ["PRIVATE-TOKEN: secret"]
+		},
+		"bad": {"flags": {"no-such-flag": "x"}}
+	}`
+	if err := os.WriteFile(file, []byte(profiles), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	dataKey := flags.String("data-key", "", "")
+	paramPage := flags.String("param-page", "", "")
+	if err := flags.Parse([]string{"--data-key", "data"}); err != nil {
+		t.Fatal(err)
+	}
+
+	headers, err := applyProfile(flags, file, "gitlab")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if *paramPage != "page" {
+		t.Errorf("Expected param-page from the profile, got %q", *paramPage)
+	}
+	if *dataKey != "data" {
+		t.Errorf("Expected data-key given to be kept, got %q", *dataKey)
+	}
+	if expected := []string{"PRIVATE-TOKEN: secret"}; !reflect.DeepEqual(headers, expected) {
+		t.Errorf("got %v; want %v", headers, expected)
+	}
+
+	for _, name := range []string{"bad", "unknown"} {
+		if _, err := applyProfile(flags, file, name); err == nil {
+			t.Errorf("Expected error for profile %s", name)
+		}
+	}
+	if _, err := applyProfile(flags, file+".missing", "gitlab"); err == nil {
+		t.Errorf("Expected error for missing file")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default headers with the requests remaining and when the limit resets
+const (
+	defaultRateRemainingHeader = "X-RateLimit-Remaining"
+	defaultRateResetHeader     = "X-RateLimit-Reset"
+)
+
+// RateThrottle keeps the requests in flight to each host under the
+// remaining requests told by its rate-limit headers, waiting until
+// the limit resets when there are none left
+type RateThrottle struct {
+	remainingHeader string
+	resetHeader     string
+	mu              sync.Mutex
+	hosts           map[string]*rateState
+}
+
+// rateState is the rate limit of a host as told by its last response
+type rateState struct {
+	inflight  int
+	remaining int // -1 if unknown
+	reset     time.Time
+	// changed is closed and replaced when a slot may be available
+	changed chan struct{}
+}
+
+// NewRateThrottle returns a throttle reading the rate-limit headers with
+// the given names, with the reset in seconds or as a Unix time
+func NewRateThrottle(remainingHeader, resetHeader string) *RateThrottle {
+	return &RateThrottle{
+		remainingHeader: remainingHeader,
+		resetHeader:     resetHeader,
+		hosts:           make(map[string]*rateState),
+	}
+}
+
+func (t *RateThrottle) state(host string) *rateState {
+	state, ok := t.hosts[host]
+	if !ok {
+		state = &rateState{remaining: -1, changed: make(chan struct{})}
+		t.hosts[host] = state
+	}
+	return state
+}
+
+// notify wakes up the requests waiting for a slot
+func (s *rateState) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Acquire waits until a request to host is within the rate limit
+// returning the function to call when it's done
+func (t *RateThrottle) Acquire(ctx context.Context, host string, opts *Options) (func(), error) {
+	for {
+		t.mu.Lock()
+		state := t.state(host)
+		if !state.reset.IsZero() && !time.Now().Before(state.reset) {
+			// The limit was reset
+			state.remaining, state.reset = -1, time.Time{}
+		}
+		if state.remaining < 0 || state.inflight < state.remaining {
+			state.inflight++
+			t.mu.Unlock()
+			return func() {
+				t.mu.Lock()
+				defer t.mu.Unlock()
+				state.inflight--
+				state.notify()
+			}, nil
+		}
+		changed := state.changed
+		var timer *time.Timer
+		var wait <-chan time.Time
+		if state.inflight == 0 {
+			// Nothing in flight will tell us more so wait for the reset
+			if state.reset.IsZero() {
+				state.remaining = -1
+				t.mu.Unlock()
+				continue
+			}
+			delay := time.Until(state.reset)
+			opts.logf(1, "Rate limit of %s reached, waiting %v until it resets", host, delay.Round(time.Second))
+			timer = time.NewTimer(delay)
+			wait = timer.C
+		}
+		t.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+		case <-changed:
+		case <-wait:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// untilReset returns how long until the rate limit of host resets if
+// there are no requests left, for the retries of the requests in flight
+func (t *RateThrottle) untilReset(host string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.state(host)
+	if state.remaining != 0 {
+		return 0
+	}
+	return max(time.Until(state.reset), 0)
+}
+
+// Update sets the rate limit of host from the headers of a response,
+// keeping the lowest remaining requests in the same window as the
+// responses may arrive in any order
+func (t *RateThrottle) Update(host string, header http.Header) {
+	remaining, err := strconv.Atoi(strings.TrimSpace(header.Get(t.remainingHeader)))
+	if err != nil {
+		return
+	}
+	remaining = max(remaining, 0)
+	var reset time.Time
+	if n, err := strconv.ParseInt(strings.TrimSpace(header.Get(t.resetHeader)), 10, 64); err == nil {
+		// Take big numbers as a Unix time and small ones as seconds
+		if n > 1e9 {
+			reset = time.Unix(n, 0)
+		} else {
+			reset = time.Now().Add(time.Duration(n) * time.Second)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.state(host)
+	switch {
+	case reset.IsZero():
+		state.remaining = remaining
+	case state.remaining >= 0 && state.reset.Sub(reset).Abs() < time.Second:
+		state.remaining = min(state.remaining, remaining)
+	default:
+		state.remaining, state.reset = remaining, reset
+	}
+	state.notify()
+}
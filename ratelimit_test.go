@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUnpage_AdaptiveRate(t *testing.T) {
+	// 5 requests allowed each second, failing the rest
+	var mu sync.Mutex
+	var window int64
+	var count int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if now := time.Now().Unix(); now != window {
+			window, count = now, 0
+		}
+		count++
+		remaining, reset := 5-count, window+1
+		mu.Unlock()
+
+		if remaining < 0 {
+			http.Error(w, "rate limited", http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("X-Left", strconv.Itoa(remaining))
+		w.Header().Set("X-Reset", strconv.FormatInt(reset, 10))
+		w.Header().Set("Link", `</?page=10>; rel="last"`)
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		json.NewEncoder(w).Encode([]any{max(page, 1)})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		ParamPage:    "page",
+		Timeout:      5 * time.Second,
+		RateThrottle: NewRateThrottle("X-Left", "X-Reset"),
+	}
+
+	entries, err := unpage(ctx, server.URL, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(entries) != 10 {
+		t.Errorf("Expected 10 entries, got %v", entries)
+	}
+}
+
+func TestUnpage_AdaptiveRateRetry(t *testing.T) {
+	// The first request is rate limited until a second later
+	var mu sync.Mutex
+	var reset time.Time
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if reset.IsZero() {
+			reset = time.Now().Add(time.Second)
+			w.Header().Set("X-Left", "0")
+			w.Header().Set("X-Reset", "1")
+			http.Error(w, "rate limited", http.StatusTooManyRequests)
+			return
+		}
+		if time.Now().Before(reset.Add(-100 * time.Millisecond)) {
+			http.Error(w, "too early", http.StatusTooManyRequests)
+			return
+		}
+		json.NewEncoder(w).Encode([]any{1})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		Retries:      1,
+		RetryMaxWait: time.Millisecond,
+		Timeout:      5 * time.Second,
+		RateThrottle: NewRateThrottle("X-Left", "X-Reset"),
+	}
+	if _, err := unpage(ctx, server.URL, opts); err != nil {
+		t.Fatalf("Expected the retry to wait for the reset, got %v", err)
+	}
+}
+
+func TestRateThrottle_Update(t *testing.T) {
+	throttle := NewRateThrottle(defaultRateRemainingHeader, defaultRateResetHeader)
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		remaining string
+		reset     string
+		expected  int
+		resetAt   time.Time
+	}{
+		{"unix time", "10", strconv.FormatInt(now.Unix()+60, 10), 10, time.Unix(now.Unix()+60, 0)},
+		{"same window", "12", strconv.FormatInt(now.Unix()+60, 10), 10, time.Unix(now.Unix()+60, 0)},
+		{"seconds", "0", "30", 0, now.Add(30 * time.Second)},
+		{"no reset", "5", "", 5, now.Add(30 * time.Second)},
+		{"invalid", "many", "", 5, now.Add(30 * time.Second)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set(defaultRateRemainingHeader, test.remaining)
+			header.Set(defaultRateResetHeader, test.reset)
+			throttle.Update("example.com", header)
+
+			state := throttle.hosts["example.com"]
+			if state.remaining != test.expected {
+				t.Errorf("Expected %d remaining, got %d", test.expected, state.remaining)
+			}
+			if diff := state.reset.Sub(test.resetAt).Abs(); diff > time.Second {
+				t.Errorf("Expected the reset at %v, got %v", test.resetAt, state.reset)
+			}
+		})
+	}
+}
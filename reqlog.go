@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Headers always redacted in the request log
+var defaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// requestLog is a line in the request log
+type requestLog struct {
+	Time       time.Time   `json:"time"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Page       int         `json:"page,omitempty"`
+	Attempt    int         `json:"attempt,omitempty"`
+	Headers    http.Header `json:"headers"`
+	Status     int         `json:"status,omitempty"`
+	Bytes      int64       `json:"bytes"`
+	DurationMS float64     `json:"duration_ms"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// requestLogTransport writes a JSON line for each request once its
+// response is read, with the secret headers redacted
+type requestLogTransport struct {
+	base   http.RoundTripper
+	redact []string
+	mu     sync.Mutex
+	enc    *json.Encoder
+}
+
+func newRequestLogTransport(base http.RoundTripper, w io.Writer, redact []string) *requestLogTransport {
+	t := &requestLogTransport{
+		base: base,
+		enc:  json.NewEncoder(w),
+	}
+	for _, name := range slices.Concat(defaultRedactHeaders, redact) {
+		t.redact = append(t.redact, http.CanonicalHeaderKey(name))
+	}
+	return t
+}
+
+func (t *requestLogTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	headers := req.Header.Clone()
+	for _, name := range t.redact {
+		if _, ok := headers[name]; ok {
+			headers[name] = []string{"REDACTED"}
+		}
+	}
+	entry := &requestLog{
+		Time:    time.Now(),
+		Method:  req.Method,
+		URL:     req.URL.String(),
+		Page:    PageFromContext(req.Context()),
+		Attempt: AttemptFromContext(req.Context()),
+		Headers: headers,
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		entry.Error = err.Error()
+		t.write(entry)
+		return nil, err
+	}
+	entry.Status = resp.StatusCode
+	resp.Body = &loggedBody{ReadCloser: resp.Body, entry: entry, t: t}
+	return resp, nil
+}
+
+func (t *requestLogTransport) write(entry *requestLog) {
+	entry.DurationMS = float64(time.Since(entry.Time).Microseconds()) / 1000
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.enc.Encode(entry)
+}
+
+// loggedBody counts the bytes read to log the request when closed
+type loggedBody struct {
+	io.ReadCloser
+	entry *requestLog
+	t     *requestLogTransport
+	once  sync.Once
+}
+
+func (b *loggedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.entry.Bytes += int64(n)
+	return n, err
+}
+
+func (b *loggedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.t.write(b.entry)
+	})
+	return err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRequestLogTransport(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", `</?page=2>; rel="last"`)
+		w.Write([]byte(`["entry"]`))
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var buf bytes.Buffer
+	opts := &Options{
+		ParamPage: "page",
+		Headers: map[string]string{
+			"Authorization": "Bearer secret",
+			"X-Api-Key":     "secret",
+			"X-Other":       "visible",
+		},
+		Timeout: 5 * time.Second,
+		WrapTransport: func(transport http.RoundTripper) http.RoundTripper {
+			return newRequestLogTransport(transport, &buf, []string{"x-api-key"})
+		},
+	}
+
+	if _, err := unpage(ctx, server.URL, opts); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var logs []requestLog
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var entry requestLog
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Invalid JSON line %q: %v", scanner.Text(), err)
+		}
+		logs = append(logs, entry)
+	}
+	if len(logs) != 2 {
+		t.Fatalf("Expected 2 lines, got %d", len(logs))
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].Page < logs[j].Page })
+	for i, entry := range logs {
+		if entry.Page != i+1 || entry.URL != server.URL+"?page="+strconv.Itoa(i+1) {
+			t.Errorf("Unexpected page %d at %s", entry.Page, entry.URL)
+		}
+		if entry.Method != http.MethodGet || entry.Status != http.StatusOK || entry.Bytes != int64(len(`["entry"]`)) {
+			t.Errorf("Unexpected %+v", entry)
+		}
+		for _, name := range []string{"Authorization", "X-Api-Key"} {
+			if got := entry.Headers.Get(name); got != "REDACTED" {
+				t.Errorf("Expected %s to be redacted, got %q", name, got)
+			}
+		}
+		if got := entry.Headers.Get("X-Other"); got != "visible" {
+			t.Errorf("Expected X-Other to be logged, got %q", got)
+		}
+	}
+}
+
+func TestRequestLogTransport_Error(t *testing.T) {
+	var buf bytes.Buffer
+	failing := roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	})
+	transport := newRequestLogTransport(failing, &buf, nil)
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if _, err := transport.RoundTrip(req); err == nil {
+		t.Fatal("Expected an error")
+	}
+	var entry requestLog
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Invalid JSON %q: %v", buf.String(), err)
+	}
+	if entry.Error != "connection refused" || entry.Status != 0 {
+		t.Errorf("Unexpected %+v", entry)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Statuses retried unless Options.RetryOn is set
+var defaultRetryOn = []int{
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// Wait before the first retry and the default maximum
+const (
+	retryBaseWait       = 500 * time.Millisecond
+	defaultRetryMaxWait = 30 * time.Second
+)
+
+// shouldRetry tells if the request failed in a way that may be transient
+func shouldRetry(ctx context.Context, resp *http.Response, err error, retryOn []int) bool {
+	if err != nil {
+		return ctx.Err() == nil && transientError(err)
+	}
+	if retryOn == nil {
+		retryOn = defaultRetryOn
+	}
+	return slices.Contains(retryOn, resp.StatusCode)
+}
+
+// transientError tells if the error is from the network or a timeout rather
+// than one that fails again like too many redirects, bad certificates or URLs
+func transientError(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &certErr) || errors.As(err, &recordErr) {
+		return false
+	}
+	// The client wraps all its errors in one that looks like a network error
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// backoff returns a random wait up to the exponential backoff for
+// the attempt, capped at maxWait, so that the concurrent requests
+// don't retry all at once
+func backoff(attempt int, maxWait time.Duration) time.Duration {
+	if maxWait <= 0 {
+		maxWait = defaultRetryMaxWait
+	}
+	wait := maxWait
+	if attempt < 32 {
+		wait = min(retryBaseWait<<attempt, maxWait)
+	}
+	return time.Duration(rand.Int63n(int64(wait) + 1))
+}
+
+// retryAfter gets the seconds in the Retry-After header
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// doWithRetries sends the request retrying up to opts.Retries times
+// on network errors and the statuses in opts.RetryOn
+func doWithRetries(ctx context.Context, client *http.Client, req *http.Request, opts *Options) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		// Rewind the body consumed by the previous attempt
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		// Sign each attempt as the signature may expire
+		if opts.Sign != nil {
+			if err := opts.Sign(req); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := client.Do(req.WithContext(context.WithValue(ctx, attemptKey{}, attempt)))
+		// The failed attempts tell the rate limit too
+		if err == nil && opts.RateThrottle != nil {
+			opts.RateThrottle.Update(req.URL.Host, resp.Header)
+		}
+		retry := shouldRetry(ctx, resp, err, opts.RetryOn)
+		// Retry errors in the body like the failed statuses
+		if err == nil && resp.StatusCode == http.StatusOK && opts.ErrorKey != "" {
+			if err = checkErrorKey(resp, opts.ErrorKey); err != nil {
+				resp.Body.Close()
+				resp = nil
+				retry = ctx.Err() == nil
+			}
+		}
+		if attempt >= opts.Retries || !retry {
+			return resp, err
+		}
+
+		wait := backoff(attempt, opts.RetryMaxWait)
+		if err != nil {
+			opts.logf(1, "Retrying %s in %v: %v", req.URL, wait, err)
+		} else {
+			if after := retryAfter(resp); after > 0 {
+				wait = after
+				if opts.RetryMaxWait > 0 {
+					wait = min(wait, opts.RetryMaxWait)
+				}
+			}
+			if opts.RateThrottle != nil {
+				wait = max(wait, opts.RateThrottle.untilReset(req.URL.Host))
+			}
+			opts.logf(1, "Retrying %s in %v: %s", req.URL, wait, resp.Status)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
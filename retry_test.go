@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShouldRetry(t *testing.T) {
+	ctx := context.Background()
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	tests := []struct {
+		status   int
+		retryOn  []int
+		expected bool
+	}{
+		{http.StatusTooManyRequests, nil, true},
+		{http.StatusInternalServerError, nil, true},
+		{http.StatusBadGateway, nil, true},
+		{http.StatusServiceUnavailable, nil, true},
+		{http.StatusGatewayTimeout, nil, true},
+		{http.StatusNotImplemented, nil, false},
+		{http.StatusNotFound, nil, false},
+		{http.StatusOK, nil, false},
+		{http.StatusServiceUnavailable, []int{429}, false},
+		{http.StatusTooManyRequests, []int{429}, true},
+		{http.StatusNotImplemented, []int{501}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d/%v", test.status, test.retryOn), func(t *testing.T) {
+			resp := &http.Response{StatusCode: test.status}
+			if result := shouldRetry(ctx, resp, nil, test.retryOn); result != test.expected {
+				t.Errorf("shouldRetry(%d, %v) = %v; want %v", test.status, test.retryOn, result, test.expected)
+			}
+		})
+	}
+
+	reset := &url.Error{Op: "Get", URL: "http://example.com", Err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}}
+	if !shouldRetry(ctx, nil, reset, nil) {
+		t.Errorf("Expected network errors to be retried")
+	}
+	eof := &url.Error{Op: "Get", URL: "http://example.com", Err: io.ErrUnexpectedEOF}
+	if !shouldRetry(ctx, nil, eof, nil) {
+		t.Errorf("Expected unexpected EOFs to be retried")
+	}
+	redirects := &url.Error{Op: "Get", URL: "http://example.com", Err: errors.New("stopped after 10 redirects")}
+	if shouldRetry(ctx, nil, redirects, nil) {
+		t.Errorf("Expected other errors not to be retried")
+	}
+	if shouldRetry(cancelled, nil, context.Canceled, nil) {
+		t.Errorf("Expected no retries after the context is done")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := range 100 {
+		if wait := backoff(attempt, 10*time.Millisecond); wait < 0 || wait > 10*time.Millisecond {
+			t.Fatalf("backoff(%d) = %v; want at most 10ms", attempt, wait)
+		}
+		limit := defaultRetryMaxWait
+		if attempt < 6 {
+			limit = retryBaseWait << attempt
+		}
+		if wait := backoff(attempt, 0); wait < 0 || wait > limit {
+			t.Fatalf("backoff(%d) = %v; want at most %v", attempt, wait, limit)
+		}
+	}
+}
+
+func TestUnpage_Retries(t *testing.T) {
+	var hits atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) <= 2 {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode([]any{1})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name    string
+		retries int
+		retryOn []int
+		hits    int32
+		wantErr bool
+	}{
+		{"no retries", 0, nil, 1, true},
+		{"not enough", 1, nil, 2, true},
+		{"enough", 2, nil, 3, false},
+		{"other statuses", 2, []int{502}, 1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hits.Store(0)
+			opts := &Options{
+				Timeout:      5 * time.Second,
+				Retries:      test.retries,
+				RetryOn:      test.retryOn,
+				RetryMaxWait: 10 * time.Millisecond,
+			}
+
+			start := time.Now()
+			_, err := unpage(ctx, server.URL, opts)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Expected error %v, got %v", test.wantErr, err)
+			}
+			if hits.Load() != test.hits {
+				t.Errorf("Expected %d requests, got %d", test.hits, hits.Load())
+			}
+			// Retry-After is capped too
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("Expected waits to be capped, took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestUnpage_RedirectsNotRetried(t *testing.T) {
+	var hits atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Redirect(w, r, "/elsewhere", http.StatusFound)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		NoRedirects:  true,
+		Retries:      3,
+		RetryMaxWait: time.Millisecond,
+		Timeout:      5 * time.Second,
+	}
+	if _, err := unpage(ctx, server.URL, opts); err == nil || !strings.Contains(err.Error(), "redirects") {
+		t.Fatalf("Expected the redirect limit error, got %v", err)
+	}
+	if hits.Load() != 1 {
+		t.Errorf("Expected 1 request, got %d", hits.Load())
+	}
+}
+
+func TestUnpage_ErrorKey(t *testing.T) {
+	var hits atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{"message": "rate limited"}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": []any{1}, "error": nil})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name    string
+		retries int
+		wantErr bool
+	}{
+		{"no retries", 0, true},
+		{"retried", 1, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hits.Store(0)
+			opts := &Options{
+				DataKey:      "data",
+				ErrorKey:     "error",
+				Timeout:      5 * time.Second,
+				Retries:      test.retries,
+				RetryMaxWait: 10 * time.Millisecond,
+			}
+
+			entries, err := unpage(ctx, server.URL, opts)
+			if test.wantErr {
+				if err == nil || !strings.Contains(err.Error(), `{"message":"rate limited"}`) {
+					t.Errorf("Expected the error in the response, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if len(entries) != 1 {
+				t.Errorf("Expected 1 entry, got %v", entries)
+			}
+		})
+	}
+}
+
+func TestUnpage_Sign(t *testing.T) {
+	// The signature covers the page parameter and page 2 fails once
+	var failed atomic.Bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Signature") != "signed "+r.URL.RequestURI() {
+			http.Error(w, "bad signature", http.StatusForbidden)
+			return
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 2 && !failed.Swap(true) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Link", `</?page=3>; rel="last"`)
+		json.NewEncoder(w).Encode([]any{page})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var signed atomic.Int32
+	opts := &Options{
+		ParamPage:    "page",
+		Retries:      1,
+		RetryMaxWait: time.Millisecond,
+		Timeout:      5 * time.Second,
+		Sign: func(req *http.Request) error {
+			signed.Add(1)
+			req.Header.Set("X-Signature", "signed "+req.URL.RequestURI())
+			return nil
+		},
+	}
+
+	entries, err := unpage(ctx, server.URL, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if expected := numbers(1, 2, 3); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected %v, got %v", expected, entries)
+	}
+	if signed.Load() != 4 {
+		t.Errorf("Expected 4 signed requests, got %d", signed.Load())
+	}
+
+	opts.Sign = func(req *http.Request) error {
+		return errors.New("no credentials")
+	}
+	if _, err := unpage(ctx, server.URL, opts); err == nil || !strings.Contains(err.Error(), "no credentials") {
+		t.Errorf("Expected the signing error, got %v", err)
+	}
+}
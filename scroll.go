@@ -0,0 +1,106 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+const (
+	defaultScrollIDKey = "_scroll_id"
+	defaultScrollURL   = "/_search/scroll"
+	defaultScrollTTL   = "1m"
+)
+
+// scrollRequest is the body posted to get the next batch of a scroll
+type scrollRequest struct {
+	Scroll   string `json:"scroll,omitempty"`
+	ScrollID string `json:"scroll_id"`
+}
+
+// scroll fetches the hits with the Elasticsearch scroll API until a batch
+// is empty, clearing the scroll context at the end
+func scroll(ctx context.Context, client *http.Client, urlStr string, opts *Options, emit func(page int, entries []any) error) error {
+	idKey := cmp.Or(opts.ScrollIDKey, defaultScrollIDKey)
+	ttl := cmp.Or(opts.ScrollTTL, defaultScrollTTL)
+	options := *opts
+	options.DataKey = cmp.Or(opts.DataKey, "hits.hits")
+
+	base, err := url.Parse(urlStr)
+	if err != nil {
+		return err
+	}
+	scrollURL, err := resolveLink(base, cmp.Or(opts.ScrollURL, defaultScrollURL))
+	if err != nil {
+		return err
+	}
+
+	params := map[string]string{
+		"scroll": ttl,
+	}
+	resp, err := doRequest(withPage(ctx, 1), client, http.MethodPost, urlStr, params, nil, opts)
+	if err != nil {
+		return err
+	}
+
+	var scrollID string
+	defer func() {
+		if scrollID != "" {
+			clearScroll(context.WithoutCancel(ctx), client, scrollURL, scrollID, opts)
+		}
+	}()
+
+	for page := 1; ; page++ {
+		rawBody, err := decodeResponse(resp, opts)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		body, ok := rawBody.(map[string]any)
+		if !ok {
+			return fmt.Errorf("unexpected type for scroll response")
+		}
+		if id, ok := getNestedValue(body, idKey).(string); ok && id != "" {
+			scrollID = id
+		}
+
+		entries, err := extractEntries(rawBody, &options)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		if err := emit(page, entries); err != nil {
+			return err
+		}
+		if scrollID == "" {
+			return fmt.Errorf("no scroll id at %s", idKey)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := sleep(ctx, opts.Delay); err != nil {
+			return err
+		}
+		request, _ := json.Marshal(&scrollRequest{Scroll: ttl, ScrollID: scrollID})
+		if resp, err = doRequest(withPage(ctx, page+1), client, http.MethodPost, scrollURL, nil, request, opts); err != nil {
+			return &PageError{Page: page + 1, Err: err}
+		}
+	}
+}
+
+// clearScroll frees the scroll context instead of waiting for it to expire
+func clearScroll(ctx context.Context, client *http.Client, scrollURL string, scrollID string, opts *Options) {
+	request, _ := json.Marshal(&scrollRequest{ScrollID: scrollID})
+	resp, err := doRequest(ctx, client, http.MethodDelete, scrollURL, nil, request, opts)
+	if err != nil {
+		opts.logf(1, "Failed to clear scroll: %v", err)
+		return
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUnpage_Scroll(t *testing.T) {
+	batches := map[string][]any{
+		"a": {map[string]any{"_source": map[string]any{"id": 3.0}}},
+		"b": {},
+	}
+	next := map[string]string{"a": "b"}
+
+	var mu sync.Mutex
+	var cleared []string
+	failed := false
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var hits []any
+		var scrollID string
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/index/_search":
+			if r.URL.Query().Get("scroll") != "5m" {
+				http.Error(w, "missing scroll", http.StatusBadRequest)
+				return
+			}
+			scrollID = "a"
+			hits = []any{
+				map[string]any{"_source": map[string]any{"id": 1.0}},
+				map[string]any{"_source": map[string]any{"id": 2.0}},
+			}
+		case r.URL.Path == "/_search/scroll":
+			var req scrollRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if r.Method == http.MethodDelete {
+				cleared = append(cleared, req.ScrollID)
+				return
+			}
+			// Fail once to check that the body is sent again
+			if !failed {
+				failed = true
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			if req.Scroll != "5m" {
+				http.Error(w, "missing scroll", http.StatusBadRequest)
+				return
+			}
+			scrollID, hits = next[req.ScrollID], batches[req.ScrollID]
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"_scroll_id": scrollID,
+			"hits":       map[string]any{"hits": hits},
+		})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := &Options{
+		EntryKey:     "_source",
+		Scroll:       true,
+		ScrollTTL:    "5m",
+		Timeout:      5 * time.Second,
+		Retries:      1,
+		RetryMaxWait: 10 * time.Millisecond,
+	}
+
+	entries, err := unpage(ctx, server.URL+"/index/_search", opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []any{
+		map[string]any{"id": json.Number("1")},
+		map[string]any{"id": json.Number("2")},
+		map[string]any{"id": json.Number("3")},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Unexpected entries: %v", entries)
+	}
+	if !reflect.DeepEqual(cleared, []string{"b"}) {
+		t.Errorf("Expected scroll b to be cleared, got %v", cleared)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignSigV4(t *testing.T) {
+	// From the AWS Signature Version 4 test suite
+	creds := &awsCredentials{
+		accessKeyID:     "AKIDEXAMPLE",
+		secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		url       string
+		signature string
+	}{
+		{"get-vanilla", "https://example.amazonaws.com/", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"get-vanilla-query-order-key-case", "https://example.amazonaws.com/?Param2=value2&Param1=value1", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, test.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := signSigV4(req, creds, "us-east-1", "service", now); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=" + test.signature
+			if got := req.Header.Get("Authorization"); got != expected {
+				t.Errorf("got %q; want %q", got, expected)
+			}
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Errorf("X-Amz-Date = %q", got)
+			}
+		})
+	}
+}
+
+func TestSigV4Escape(t *testing.T) {
+	tests := []struct {
+		s           string
+		escapeSlash bool
+		expected    string
+	}{
+		{"a-b_c.d~e", true, "a-b_c.d~e"},
+		{"a b+c", true, "a%20b%2Bc"},
+		{"/a/b c", false, "/a/b%20c"},
+		{"/a", true, "%2Fa"},
+	}
+
+	for _, test := range tests {
+		if got := sigV4Escape(test.s, test.escapeSlash); got != test.expected {
+			t.Errorf("sigV4Escape(%q, %v) = %q; want %q", test.s, test.escapeSlash, got, test.expected)
+		}
+	}
+}
+
+func TestAWSSigV4_Credentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	if _, err := awsSigV4("us-east-1", "execute-api"); err == nil {
+		t.Errorf("Expected error without credentials")
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "token")
+	sign, err := awsSigV4("us-east-1", "execute-api")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/items?page=2", nil)
+	if err := sign(req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if req.Header.Get("X-Amz-Security-Token") != "token" {
+		t.Errorf("Expected the session token to be set")
+	}
+	if auth := req.Header.Get("Authorization"); !strings.Contains(auth, "SignedHeaders=host;x-amz-date;x-amz-security-token,") {
+		t.Errorf("Expected the session token to be signed, got %q", auth)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+type pageKey struct{}
+type attemptKey struct{}
+
+// withPage returns a context for the requests for page
+func withPage(ctx context.Context, page int) context.Context {
+	return context.WithValue(ctx, pageKey{}, page)
+}
+
+// PageFromContext returns the page number of a request, or 0 if unknown,
+// so that an Options.WrapTransport can record it
+func PageFromContext(ctx context.Context) int {
+	page, _ := ctx.Value(pageKey{}).(int)
+	return page
+}
+
+// AttemptFromContext returns the number of retries before a request
+func AttemptFromContext(ctx context.Context) int {
+	attempt, _ := ctx.Value(attemptKey{}).(int)
+	return attempt
+}
+
+// traceTransport logs the timings of each request like a span
+type traceTransport struct {
+	base   http.RoundTripper
+	logger *log.Logger
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var dns, connect, tlsStart, wrote, firstByte time.Time
+	var dnsDone, connectDone, tlsDone time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { dns = time.Now() },
+		DNSDone:              func(httptrace.DNSDoneInfo) { dnsDone = time.Now() },
+		ConnectStart:         func(_, _ string) { connect = time.Now() },
+		ConnectDone:          func(_, _ string, _ error) { connectDone = time.Now() },
+		TLSHandshakeStart:    func() { tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { tlsDone = time.Now() },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { wrote = time.Now() },
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}
+
+	start := time.Now()
+	ctx := req.Context()
+	resp, err := t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(ctx, trace)))
+	total := time.Since(start)
+
+	// since is the time between the events or 0 if they didn't happen
+	since := func(from, to time.Time) time.Duration {
+		if from.IsZero() || to.IsZero() {
+			return 0
+		}
+		return to.Sub(from).Round(time.Microsecond)
+	}
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	line := fmt.Sprintf("TRACE %s %s page=%d attempt=%d status=%d dns=%v connect=%v tls=%v ttfb=%v total=%v",
+		req.Method, req.URL, PageFromContext(ctx), AttemptFromContext(ctx), status,
+		since(dns, dnsDone), since(connect, connectDone), since(tlsStart, tlsDone), since(wrote, firstByte),
+		total.Round(time.Microsecond))
+	if err != nil {
+		line += fmt.Sprintf(" error=%q", err)
+	}
+	t.logger.Print(line)
+	return resp, err
+}
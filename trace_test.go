@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// roundTripperFunc turns a function into an http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestUnpage_WrapTransport(t *testing.T) {
+	var failed atomic.Bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail page 2 once
+		if r.URL.Query().Get("page") == "2" && !failed.Swap(true) {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Link", `</?page=3>; rel="last"`)
+		json.NewEncoder(w).Encode([]any{1})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	var requests []string
+	opts := &Options{
+		ParamPage:    "page",
+		Timeout:      5 * time.Second,
+		Retries:      1,
+		RetryMaxWait: 10 * time.Millisecond,
+		WrapTransport: func(transport http.RoundTripper) http.RoundTripper {
+			return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				mu.Lock()
+				requests = append(requests, strconv.Itoa(PageFromContext(req.Context()))+"/"+strconv.Itoa(AttemptFromContext(req.Context())))
+				mu.Unlock()
+				return transport.RoundTrip(req)
+			})
+		},
+	}
+
+	if _, err := unpage(ctx, server.URL, opts); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	sort.Strings(requests)
+	if expected := []string{"1/0", "2/0", "2/1", "3/0"}; !reflect.DeepEqual(requests, expected) {
+		t.Errorf("got %v; want %v", requests, expected)
+	}
+}
+
+func TestTraceTransport(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]any{1})
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	var buf strings.Builder
+	transport := &traceTransport{base: http.DefaultTransport, logger: log.New(&buf, "", 0)}
+	req, _ := http.NewRequestWithContext(withPage(context.Background(), 7), http.MethodGet, server.URL, nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	resp.Body.Close()
+
+	for _, s := range []string{"TRACE GET " + server.URL, "page=7", "attempt=0", "status=200", "connect=", "ttfb=", "total="} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("Expected %q in log, got %q", s, buf.String())
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/itchyny/gojq"
+)
+
+// compileTransform compiles the jq expression into a function that returns
+// the values it yields for an entry
+func compileTransform(expr string) (func(entry any) ([]any, error), error) {
+	query, err := gojq.Parse(expr)
+	if err != nil {
+		return nil, err
+	}
+	code, err := gojq.Compile(query)
+	if err != nil {
+		return nil, err
+	}
+	return func(entry any) ([]any, error) {
+		var values []any
+		iter := code.Run(entry)
+		for {
+			value, ok := iter.Next()
+			if !ok {
+				return values, nil
+			}
+			if err, ok := value.(error); ok {
+				var halt *gojq.HaltError
+				if errors.As(err, &halt) && halt.Value() == nil {
+					return values, nil
+				}
+				return nil, err
+			}
+			values = append(values, value)
+		}
+	}, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompileTransform(t *testing.T) {
+	entry := map[string]any{"id": 1.0, "tags": []any{"a", "b"}}
+
+	tests := []struct {
+		expr     string
+		expected []any
+	}{
+		{".id", []any{1.0}},
+		{"{id}", []any{map[string]any{"id": 1.0}}},
+		{".tags[]", []any{"a", "b"}},
+		{"select(.id > 1)", nil},
+		{"empty", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			transform, err := compileTransform(test.expr)
+			if err != nil {
+				t.Fatalf("compileTransform(%q) returned an error: %v", test.expr, err)
+			}
+			values, err := transform(entry)
+			if err != nil {
+				t.Fatalf("transform returned an error: %v", err)
+			}
+			if !reflect.DeepEqual(values, test.expected) {
+				t.Errorf("transform = %v; want %v", values, test.expected)
+			}
+		})
+	}
+
+	if _, err := compileTransform(".id |"); err == nil {
+		t.Errorf("Expected parse error")
+	}
+	if _, err := compileTransform("$undefined"); err == nil {
+		t.Errorf("Expected compile error")
+	}
+}
+
+func TestTransformEmit(t *testing.T) {
+	transform, err := compileTransform(".id | tonumber")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var emitted []any
+	emit := transformEmit(func(page int, entries []any) error {
+		emitted = append(emitted, entries...)
+		return nil
+	}, transform)
+
+	if err := emit(1, []any{map[string]any{"id": "1"}, map[string]any{"id": "2"}}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(emitted, []any{1, 2}) {
+		t.Errorf("Unexpected entries: %v", emitted)
+	}
+
+	err = emit(2, []any{map[string]any{"id": "3"}, map[string]any{"id": "x"}})
+	if err == nil || !strings.Contains(err.Error(), "entry 3") {
+		t.Errorf("Expected error for entry 3, got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// errUntil stops the pagination when an entry matches Options.Until
+var errUntil = errors.New("until")
+
+// Operators for --until with whether they match the comparison result
+var untilOps = map[string]func(c int) bool{
+	"eq": func(c int) bool { return c == 0 },
+	"ne": func(c int) bool { return c != 0 },
+	"lt": func(c int) bool { return c < 0 },
+	"le": func(c int) bool { return c <= 0 },
+	"gt": func(c int) bool { return c > 0 },
+	"ge": func(c int) bool { return c >= 0 },
+}
+
+// parseUntil parses a "FIELD OP VALUE" predicate that is true for the
+// object entries where the value at the dot-path FIELD compares with VALUE
+// as numbers if both are numbers and as strings otherwise
+func parseUntil(s string) (func(entry any) bool, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("expected \"FIELD OP VALUE\": %s", s)
+	}
+	field, op := fields[0], untilOps[fields[1]]
+	if op == nil {
+		return nil, fmt.Errorf("unknown operator %q, expected one of eq, ne, lt, le, gt, ge", fields[1])
+	}
+	value := strings.Join(fields[2:], " ")
+
+	return func(entry any) bool {
+		m, ok := entry.(map[string]any)
+		if !ok {
+			return false
+		}
+		c, ok := compareValue(getNestedValue(m, field), value)
+		return ok && op(c)
+	}, nil
+}
+
+// compareValue compares the JSON value with s, returning false
+// if they can't be compared
+func compareValue(value any, s string) (int, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		a, err1 := v.Float64()
+		b, err2 := strconv.ParseFloat(s, 64)
+		if err1 != nil || err2 != nil {
+			return strings.Compare(v.String(), s), true
+		}
+		return cmp.Compare(a, b), true
+	case float64:
+		b, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return strings.Compare(strconv.FormatFloat(v, 'f', -1, 64), s), true
+		}
+		return cmp.Compare(v, b), true
+	case string:
+		return strings.Compare(v, s), true
+	case bool:
+		return strings.Compare(strconv.FormatBool(v), s), true
+	default:
+		return 0, false
+	}
+}
+
+// untilEmit wraps emit to pass the entries before the first one matching
+// until and then stop with errUntil
+func untilEmit(emit func(page int, entries []any) error, until func(entry any) bool) func(page int, entries []any) error {
+	stopped := false
+	return func(page int, entries []any) error {
+		if stopped {
+			return errUntil
+		}
+		for i, entry := range entries {
+			if until(entry) {
+				stopped = true
+				if err := emit(page, entries[:i]); err != nil {
+					return err
+				}
+				return errUntil
+			}
+		}
+		return emit(page, entries)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseUntil(t *testing.T) {
+	entry := map[string]any{
+		"id":      json.Number("10"),
+		"created": "2024-03-01T00:00:00Z",
+		"meta":    map[string]any{"score": 1.5, "done": true},
+	}
+
+	tests := []struct {
+		until    string
+		expected bool
+		wantErr  bool
+	}{
+		{"id lt 9", false, false},
+		{"id lt 11", true, false},
+		{"id eq 10.0", true, false},
+		{"id ge 10", true, false},
+		{"created lt 2024-01-01", false, false},
+		{"created ge 2024-01-01", true, false},
+		{"meta.score gt 1", true, false},
+		{"meta.done eq true", true, false},
+		{"meta.done ne true", false, false},
+		{"missing eq 1", false, false},
+		{"id", false, true},
+		{"id like 10", false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.until, func(t *testing.T) {
+			until, err := parseUntil(test.until)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Expected error %v, got %v", test.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if result := until(entry); result != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, result)
+			}
+			if until("not an object") {
+				t.Errorf("Expected no match for entries that aren't objects")
+			}
+		})
+	}
+}
+
+func TestUnpage_Until(t *testing.T) {
+	// 5 pages of 3 entries sorted by n from 15 down to 1
+	var hits atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		page = max(page, 1)
+		if r.URL.Query().Has("next") {
+			if page < 5 {
+				w.Header().Set("Link", fmt.Sprintf(`</?next&page=%d>; rel="next"`, page+1))
+			}
+		} else {
+			w.Header().Set("Link", `</?page=5>; rel="last"`)
+		}
+		var entries []any
+		for i := range 3 {
+			entries = append(entries, map[string]any{"n": 15 - (page-1)*3 - i})
+		}
+		json.NewEncoder(w).Encode(entries)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	until, err := parseUntil("n le 8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []any
+	for n := 15; n > 8; n-- {
+		expected = append(expected, map[string]any{"n": json.Number(strconv.Itoa(n))})
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		hits int32
+	}{
+		{"last link", server.URL, 0},
+		{"next link", server.URL + "?next", 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hits.Store(0)
+			opts := &Options{
+				ParamPage: "page",
+				Until:     until,
+				Timeout:   5 * time.Second,
+			}
+			entries, err := unpage(ctx, test.url, opts)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(entries, expected) {
+				t.Errorf("Expected %v, got %v", expected, entries)
+			}
+			if test.hits > 0 && hits.Load() != test.hits {
+				t.Errorf("Expected %d requests, got %d", test.hits, hits.Load())
+			}
+		})
+	}
+}